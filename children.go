@@ -0,0 +1,198 @@
+package firetest
+
+import (
+	"net/url"
+	"reflect"
+	"sync"
+)
+
+// ChildEventType is the kind of change made to a child
+type ChildEventType string
+
+const (
+	// ChildAdded is sent for each existing child when watching
+	// starts and for every child added afterwards
+	ChildAdded ChildEventType = "child_added"
+	// ChildChanged is sent when the data of a child changes
+	ChildChanged ChildEventType = "child_changed"
+	// ChildRemoved is sent when a child is removed
+	ChildRemoved ChildEventType = "child_removed"
+	// ChildMoved is sent when a change moves a child
+	// to a different position in the ordering
+	ChildMoved ChildEventType = "child_moved"
+)
+
+// ChildEvent describes a change to a child of a watched location
+type ChildEvent struct {
+	Type ChildEventType
+	// Key is the key of the child
+	Key string
+	// Value is the value of the child, which for
+	// ChildRemoved is the value it had before removal
+	Value interface{}
+	// PrevKey is the key of the child before this one in
+	// the ordering, or empty if it is the first child.
+	// It is always empty for ChildRemoved.
+	PrevKey string
+}
+
+// WatchChildren returns a channel on which the changes made to the
+// children of the given location are delivered, along with a function
+// that stops watching and closes the channel.
+//
+// The query parameters orderBy, startAt, endAt, equalTo, limitToFirst
+// and limitToLast determine the ordering of the children and which of
+// them are watched, in which case children entering and leaving the
+// results are reported as added and removed. Without them children
+// are ordered by priority and then by key.
+//
+// Reference https://www.firebase.com/docs/web/guide/retrieving-data.html#section-event-types
+func (ft *Firetest) WatchChildren(path string, params url.Values) (<-chan ChildEvent, func(), error) {
+	q, err := parseQuery(params)
+	if err != nil {
+		return nil, nil, err
+	}
+	if q == nil {
+		q = &query{orderBy: orderByPriority}
+	}
+	if path, err = ft.validPath(path); err != nil {
+		return nil, nil, err
+	}
+
+	// the data is read once and then kept up to
+	// date with the changes carried by each event
+	c, data := ft.db.watchData(path)
+
+	var (
+		view   = &childView{q: q}
+		events = make(chan ChildEvent)
+		stop   = make(chan struct{})
+		once   sync.Once
+	)
+
+	go func() {
+		defer close(events)
+
+		send := func(ces []ChildEvent) bool {
+			for _, ce := range ces {
+				select {
+				case events <- ce:
+				case <-stop:
+					return false
+				}
+			}
+			return true
+		}
+
+		if !send(view.update(data)) {
+			return
+		}
+		for e := range c {
+			if e.Name != eventPut && e.Name != eventPatch {
+				continue
+			}
+
+			data = e.apply(data)
+			if !send(view.update(data)) {
+				return
+			}
+		}
+	}()
+
+	cancel := func() {
+		once.Do(func() {
+			close(stop)
+			ft.db.stopWatching(path, c)
+		})
+	}
+	return events, cancel, nil
+}
+
+// childView holds the ordered children of a watched location
+type childView struct {
+	q    *query
+	kids []queryChild
+}
+
+// update replaces the children with those of n and returns the
+// events describing the differences, in the order Firebase sends
+// them: removals, additions, moves and then changes.
+func (v *childView) update(n *node) []ChildEvent {
+	var next []queryChild
+	if !n.isNil() {
+		for _, kid := range v.q.filter(v.q.sortedChildren(n)) {
+			if !kid.node.isNil() {
+				next = append(next, kid)
+			}
+		}
+	}
+	prev := v.kids
+	v.kids = next
+
+	var (
+		prevIndex = indexChildren(prev)
+		nextIndex = indexChildren(next)
+
+		removed, added, moved, changed []ChildEvent
+	)
+	for _, kid := range prev {
+		if _, ok := nextIndex[kid.key]; !ok {
+			removed = append(removed, ChildEvent{Type: ChildRemoved, Key: kid.key, Value: kid.node.objectify()})
+		}
+	}
+
+	prevCommon, nextCommon := commonPredecessors(prev, nextIndex), commonPredecessors(next, prevIndex)
+	for i, kid := range next {
+		var prevKey string
+		if i > 0 {
+			prevKey = next[i-1].key
+		}
+		ce := ChildEvent{Key: kid.key, Value: kid.node.objectify(), PrevKey: prevKey}
+
+		j, ok := prevIndex[kid.key]
+		switch {
+		case !ok:
+			ce.Type = ChildAdded
+			added = append(added, ce)
+			continue
+		case reflect.DeepEqual(prev[j].node.export(), kid.node.export()):
+			continue
+		}
+
+		if prevCommon[kid.key] != nextCommon[kid.key] {
+			ce.Type = ChildMoved
+			moved = append(moved, ce)
+		}
+		ce.Type = ChildChanged
+		changed = append(changed, ce)
+	}
+
+	events := append(removed, added...)
+	events = append(events, moved...)
+	return append(events, changed...)
+}
+
+func indexChildren(kids []queryChild) map[string]int {
+	index := make(map[string]int, len(kids))
+	for i, kid := range kids {
+		index[kid.key] = i
+	}
+	return index
+}
+
+// commonPredecessors maps each child of kids that is also in other to
+// the key of the closest child before it that is also in other. Comparing
+// them before and after a change tells whether a child moved relative to
+// the others, regardless of the children added or removed around it.
+func commonPredecessors(kids []queryChild, other map[string]int) map[string]string {
+	preds := map[string]string{}
+	var last string
+	for _, kid := range kids {
+		if _, ok := other[kid.key]; !ok {
+			continue
+		}
+		preds[kid.key] = last
+		last = kid.key
+	}
+	return preds
+}
@@ -0,0 +1,190 @@
+package firetest
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestChildViewUpdate(t *testing.T) {
+	q, err := parseQuery(url.Values{"orderBy": {`"$value"`}})
+	require.NoError(t, err)
+	v := &childView{q: q}
+
+	for _, test := range []struct {
+		name     string
+		data     interface{}
+		expected []ChildEvent
+	}{
+		{
+			name: "initial children",
+			data: map[string]interface{}{"a": 1, "b": 2},
+			expected: []ChildEvent{
+				{Type: ChildAdded, Key: "a", Value: json.Number("1")},
+				{Type: ChildAdded, Key: "b", Value: json.Number("2"), PrevKey: "a"},
+			},
+		},
+		{
+			name: "no change",
+			data: map[string]interface{}{"a": 1, "b": 2},
+		},
+		{
+			name: "child added in the middle",
+			data: map[string]interface{}{"a": 1, "b": 2, "c": 1.5},
+			expected: []ChildEvent{
+				{Type: ChildAdded, Key: "c", Value: json.Number("1.5"), PrevKey: "a"},
+			},
+		},
+		{
+			name: "child changed in place",
+			data: map[string]interface{}{"a": 1, "b": 3, "c": 1.5},
+			expected: []ChildEvent{
+				{Type: ChildChanged, Key: "b", Value: json.Number("3"), PrevKey: "c"},
+			},
+		},
+		{
+			name: "child moved",
+			data: map[string]interface{}{"a": 4, "b": 3, "c": 1.5},
+			expected: []ChildEvent{
+				{Type: ChildMoved, Key: "a", Value: json.Number("4"), PrevKey: "b"},
+				{Type: ChildChanged, Key: "a", Value: json.Number("4"), PrevKey: "b"},
+			},
+		},
+		{
+			name: "child removed and added",
+			data: map[string]interface{}{"a": 4, "b": 3, "d": 0},
+			expected: []ChildEvent{
+				{Type: ChildRemoved, Key: "c", Value: json.Number("1.5")},
+				{Type: ChildAdded, Key: "d", Value: json.Number("0")},
+			},
+		},
+		{
+			name: "all removed",
+			expected: []ChildEvent{
+				{Type: ChildRemoved, Key: "d", Value: json.Number("0")},
+				{Type: ChildRemoved, Key: "b", Value: json.Number("3")},
+				{Type: ChildRemoved, Key: "a", Value: json.Number("4")},
+			},
+		},
+	} {
+		assert.Equal(t, test.expected, v.update(newNode(test.data)), test.name)
+	}
+}
+
+func TestChildViewWindow(t *testing.T) {
+	q, err := parseQuery(url.Values{"orderBy": {`"$key"`}, "limitToFirst": {"2"}})
+	require.NoError(t, err)
+	v := &childView{q: q}
+
+	v.update(newNode(map[string]interface{}{"b": 1, "c": 2, "d": 3}))
+	assert.Equal(t, []ChildEvent{
+		{Type: ChildRemoved, Key: "c", Value: json.Number("2")},
+		{Type: ChildAdded, Key: "a", Value: json.Number("0")},
+	}, v.update(newNode(map[string]interface{}{"a": 0, "b": 1, "c": 2, "d": 3})))
+}
+
+func TestPatched(t *testing.T) {
+	n := newNode(map[string]interface{}{"a": 1, "b": 2})
+	patch, err := newUpdate("", map[string]interface{}{"b": nil, "c": 3, ".priority": 1})
+	require.NoError(t, err)
+	p := patched(n, patch)
+	assert.Equal(t, map[string]interface{}{"a": json.Number("1"), "c": json.Number("3")}, p.objectify())
+	assert.Equal(t, json.Number("1"), p.priority)
+	assert.Equal(t, map[string]interface{}{"a": json.Number("1"), "b": json.Number("2")}, n.objectify(), "original node should be untouched")
+}
+
+func TestWatchChildren(t *testing.T) {
+	ft := New()
+	ft.Set("list", map[string]interface{}{
+		"a": map[string]interface{}{".value": "first", ".priority": 1},
+		"b": map[string]interface{}{".value": "second", ".priority": 2},
+	})
+
+	events, cancel, err := ft.WatchChildren("list", nil)
+	require.NoError(t, err)
+	defer cancel()
+
+	ft.Set("list/c", "third")
+	ft.Update("list", map[string]interface{}{"a": "changed"})
+	ft.Set("list/b/.priority", 0)
+	ft.Delete("list/c")
+	ft.Set("other", true)
+	ft.Set("list/d/deep", true)
+
+	for _, expected := range []ChildEvent{
+		{Type: ChildAdded, Key: "a", Value: "first"},
+		{Type: ChildAdded, Key: "b", Value: "second", PrevKey: "a"},
+		// children without a priority come first
+		{Type: ChildAdded, Key: "c", Value: "third"},
+		// updating a child clears its priority
+		{Type: ChildMoved, Key: "a", Value: "changed"},
+		{Type: ChildChanged, Key: "a", Value: "changed"},
+		{Type: ChildChanged, Key: "b", Value: "second", PrevKey: "c"},
+		{Type: ChildRemoved, Key: "c", Value: "third"},
+		{Type: ChildAdded, Key: "d", Value: map[string]interface{}{"deep": true}, PrevKey: "a"},
+	} {
+		select {
+		case e := <-events:
+			assert.Equal(t, expected, e)
+		case <-time.After(time.Second):
+			t.Fatalf("no event received, expected %v", expected)
+		}
+	}
+}
+
+func TestWatchChildrenConcurrentWrites(t *testing.T) {
+	ft := New()
+
+	const writers = 4
+	done := make(chan struct{})
+	defer close(done)
+	for w := 0; w < writers; w++ {
+		path := fmt.Sprintf("list/%d", w)
+		ft.Set(path, 0)
+		go func() {
+			for i := 1; ; i++ {
+				select {
+				case <-done:
+					return
+				default:
+					ft.Set(path, i)
+				}
+			}
+		}()
+	}
+
+	for w := 0; w < 100; w++ {
+		events, cancel, err := ft.WatchChildren("list", nil)
+		require.NoError(t, err)
+
+		// writes made while watching starts must be received exactly
+		// once, so no child goes back to an older value
+		last := map[string]int64{}
+		for i := 0; i < 4*writers; i++ {
+			select {
+			case e := <-events:
+				v, err := e.Value.(json.Number).Int64()
+				require.NoError(t, err)
+				prev, ok := last[e.Key]
+				require.True(t, !ok || v > prev, "%s %s to %d after %d", e.Type, e.Key, v, prev)
+				last[e.Key] = v
+			case <-time.After(time.Second):
+				t.Fatal("no event received")
+			}
+		}
+		cancel()
+	}
+}
+
+func TestWatchChildrenInvalidQuery(t *testing.T) {
+	_, _, err := New().WatchChildren("list", url.Values{"limitToFirst": {"1"}})
+	assert.Error(t, err)
+
+	_, _, err = New().WatchChildren("li$t", nil)
+	assert.IsType(t, &PathError{}, err)
+}
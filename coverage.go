@@ -0,0 +1,268 @@
+package firetest
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"io"
+	"sort"
+	"strings"
+	"sync/atomic"
+)
+
+// RuleCoverage holds the evaluation counts of a single rule
+type RuleCoverage struct {
+	// Rule is the location of the rule in the rules
+	// document, e.g. /rules/users/$uid/.write
+	Rule string `json:"rule"`
+	// Expression is the source of the rule
+	Expression string `json:"expression"`
+	// Line is the line of the rules document the rule is defined on
+	Line int `json:"line"`
+	// Hits is the number of times the rule was evaluated
+	Hits int64 `json:"hits"`
+	// True, False and Errors break down Hits by result
+	True   int64 `json:"true"`
+	False  int64 `json:"false"`
+	Errors int64 `json:"errors"`
+
+	constant bool
+}
+
+// Covered returns true if the rule has been evaluated
+func (rc RuleCoverage) Covered() bool {
+	return rc.Hits > 0
+}
+
+// Partial returns true if the rule has been evaluated but has
+// not yet produced both a true and a false result. Rules that
+// are a constant value are never partial.
+func (rc RuleCoverage) Partial() bool {
+	return rc.Covered() && !rc.constant && (rc.True == 0 || rc.False == 0)
+}
+
+// CoverageReport is a snapshot of the rules evaluated
+// by a Firetest server since the rules were loaded
+type CoverageReport struct {
+	// Source is the rules document
+	Source string `json:"source"`
+	// Rules lists every rule in the document ordered by line
+	Rules []RuleCoverage `json:"rules"`
+}
+
+// Coverage returns the evaluation counts of every rule in the
+// loaded security rules. It returns nil if no rules are loaded.
+// Counts are reset whenever new rules are loaded with SetRules.
+func (ft *Firetest) Coverage() *CoverageReport {
+	r := ft.getRules()
+	if r == nil {
+		return nil
+	}
+
+	c := &CoverageReport{Source: string(r.source)}
+	for _, rule := range r.all {
+		rc := RuleCoverage{
+			Rule:       rule.location,
+			Expression: rule.source,
+			Line:       rule.line,
+			True:       atomic.LoadInt64(&rule.trueCount),
+			False:      atomic.LoadInt64(&rule.falseCount),
+			Errors:     atomic.LoadInt64(&rule.errorCount),
+		}
+		rc.Hits = rc.True + rc.False + rc.Errors
+		_, rc.constant = rule.expr.(literalExpr)
+		c.Rules = append(c.Rules, rc)
+	}
+	sort.Sort(byLine(c.Rules))
+	return c
+}
+
+// Covered returns the number of rules that have been evaluated
+func (c *CoverageReport) Covered() int {
+	var n int
+	for _, rc := range c.Rules {
+		if rc.Covered() {
+			n++
+		}
+	}
+	return n
+}
+
+// WriteJSON writes the report to w as JSON
+func (c *CoverageReport) WriteJSON(w io.Writer) error {
+	b, err := json.MarshalIndent(c, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(append(b, '\n'))
+	return err
+}
+
+// coverageLine is a line of the rules document in the HTML report
+type coverageLine struct {
+	Number int
+	Text   string
+	Class  string
+	Hits   string
+	Rules  []RuleCoverage
+}
+
+// WriteHTML writes the report to w as a standalone HTML page
+// showing the rules document annotated with the coverage of
+// each line.
+func (c *CoverageReport) WriteHTML(w io.Writer) error {
+	byNumber := map[int][]RuleCoverage{}
+	for _, rc := range c.Rules {
+		byNumber[rc.Line] = append(byNumber[rc.Line], rc)
+	}
+
+	var lines []coverageLine
+	for i, text := range strings.Split(c.Source, "\n") {
+		l := coverageLine{Number: i + 1, Text: text, Rules: byNumber[i+1]}
+		if len(l.Rules) > 0 {
+			var hits int64
+			l.Class = "covered"
+			for _, rc := range l.Rules {
+				hits += rc.Hits
+				switch {
+				case !rc.Covered():
+					l.Class = "uncovered"
+				case rc.Partial() && l.Class == "covered":
+					l.Class = "partial"
+				}
+			}
+			l.Hits = fmt.Sprint(hits) + "x"
+		}
+		lines = append(lines, l)
+	}
+
+	return coverageTemplate.Execute(w, map[string]interface{}{
+		"Covered": c.Covered(),
+		"Total":   len(c.Rules),
+		"Lines":   lines,
+	})
+}
+
+var coverageTemplate = template.Must(template.New("coverage").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Security rules coverage</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+table { border-collapse: collapse; font-family: monospace; }
+td { padding: 0 .5em; white-space: pre; vertical-align: top; }
+td.line, td.hits { color: #999; text-align: right; }
+tr.covered { background: #dfd; }
+tr.partial { background: #ffd; }
+tr.uncovered { background: #fdd; }
+</style>
+</head>
+<body>
+<h1>Security rules coverage</h1>
+<p>{{.Covered}} of {{.Total}} rules evaluated</p>
+<table>
+{{range .Lines}}<tr class="{{.Class}}"{{if .Rules}} title="{{range $i, $r := .Rules}}{{if $i}}&#10;{{end}}{{$r.Rule}}: {{$r.True}} true, {{$r.False}} false, {{$r.Errors}} errors{{end}}"{{end}}><td class="line">{{.Number}}</td><td class="hits">{{.Hits}}</td><td>{{.Text}}</td></tr>
+{{end}}</table>
+</body>
+</html>
+`))
+
+type byLine []RuleCoverage
+
+func (a byLine) Len() int      { return len(a) }
+func (a byLine) Swap(i, j int) { a[i], a[j] = a[j], a[i] }
+func (a byLine) Less(i, j int) bool {
+	if a[i].Line != a[j].Line {
+		return a[i].Line < a[j].Line
+	}
+	return a[i].Rule < a[j].Rule
+}
+
+// ruleLines maps the location of every key in a rules document,
+// e.g. /rules/users/$uid/.read, to the line it is defined on.
+// The document must be valid JSON with any comments blanked out.
+func ruleLines(src []byte) map[string]int {
+	s := &lineScanner{src: src, lines: map[string]int{}}
+	s.value("")
+	return s.lines
+}
+
+type lineScanner struct {
+	src   []byte
+	pos   int
+	lines map[string]int
+}
+
+func (s *lineScanner) skipSpace() {
+	for s.pos < len(s.src) && strings.IndexByte(" \t\r\n", s.src[s.pos]) >= 0 {
+		s.pos++
+	}
+}
+
+func (s *lineScanner) value(location string) {
+	s.skipSpace()
+	if s.pos >= len(s.src) {
+		return
+	}
+
+	switch s.src[s.pos] {
+	case '{':
+		s.object(location)
+	case '[':
+		s.pos++
+		for s.skipSpace(); s.pos < len(s.src) && s.src[s.pos] != ']'; s.skipSpace() {
+			s.value(location)
+			s.skipSpace()
+			if s.pos < len(s.src) && s.src[s.pos] == ',' {
+				s.pos++
+			}
+		}
+		s.pos++
+	case '"':
+		s.str()
+	default:
+		for s.pos < len(s.src) && strings.IndexByte(",}] \t\r\n", s.src[s.pos]) < 0 {
+			s.pos++
+		}
+	}
+}
+
+func (s *lineScanner) object(location string) {
+	s.pos++
+	for s.skipSpace(); s.pos < len(s.src) && s.src[s.pos] != '}'; s.skipSpace() {
+		line := bytes.Count(s.src[:s.pos], []byte{'\n'}) + 1
+		key := location + "/" + s.str()
+		s.lines[key] = line
+
+		s.skipSpace()
+		if s.pos < len(s.src) && s.src[s.pos] == ':' {
+			s.pos++
+		}
+		s.value(key)
+		s.skipSpace()
+		if s.pos < len(s.src) && s.src[s.pos] == ',' {
+			s.pos++
+		}
+	}
+	s.pos++
+}
+
+// str consumes a JSON string and returns its value
+func (s *lineScanner) str() string {
+	start := s.pos
+	for s.pos++; s.pos < len(s.src) && s.src[s.pos] != '"'; s.pos++ {
+		if s.src[s.pos] == '\\' {
+			s.pos++
+		}
+	}
+	s.pos++
+	if s.pos > len(s.src) {
+		s.pos = len(s.src)
+	}
+
+	var v string
+	json.Unmarshal(s.src[start:s.pos], &v)
+	return v
+}
@@ -0,0 +1,127 @@
+package firetest
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRuleLines(t *testing.T) {
+	lines := ruleLines(stripComments([]byte(testRules)))
+
+	for location, line := range map[string]int{
+		"/rules":                             3,
+		"/rules/.read":                       4,
+		"/rules/public/.write":               8,
+		"/rules/users/$uid/.validate":        14,
+		"/rules/users/$uid/$other/.validate": 22,
+		"/rules/messages/.indexOn":           27,
+		"/rules/messages/$id/.write":         29,
+	} {
+		assert.Equal(t, line, lines[location], location)
+	}
+}
+
+func TestCoverageWithoutRules(t *testing.T) {
+	assert.Nil(t, New().Coverage())
+}
+
+func TestCoverage(t *testing.T) {
+	ft := New()
+	require.NoError(t, ft.SetRules([]byte(testRules)))
+
+	c := ft.Coverage()
+	require.NotNil(t, c)
+	assert.Equal(t, testRules, c.Source)
+	require.Len(t, c.Rules, 11)
+	assert.Equal(t, 0, c.Covered())
+	assert.Equal(t, RuleCoverage{
+		Rule:       "/rules/.read",
+		Expression: "auth != null && auth.admin === true",
+		Line:       4,
+	}, c.Rules[0])
+	assert.Equal(t, "/rules/messages/$id/createdAt/.validate", c.Rules[10].Rule)
+	assert.Equal(t, 31, c.Rules[10].Line)
+
+	alice := map[string]interface{}{"uid": "alice"}
+	ft.Simulate(alice, "GET", "/users/alice", nil)
+	ft.Simulate(alice, "GET", "/users/bob", nil)
+	ft.Simulate(map[string]interface{}{"admin": "yes"}, "GET", "/", nil)
+
+	c = ft.Coverage()
+	assert.Equal(t, 2, c.Covered())
+
+	root := c.Rules[0]
+	assert.Equal(t, int64(3), root.Hits)
+	assert.Equal(t, int64(3), root.False)
+	assert.True(t, root.Partial())
+
+	user := c.Rules[3]
+	assert.Equal(t, "/rules/users/$uid/.read", user.Rule)
+	assert.Equal(t, int64(2), user.Hits)
+	assert.Equal(t, int64(1), user.True)
+	assert.Equal(t, int64(1), user.False)
+	assert.False(t, user.Partial())
+
+	// loading rules resets the counters
+	require.NoError(t, ft.SetRules([]byte(testRules)))
+	assert.Equal(t, 0, ft.Coverage().Covered())
+}
+
+func TestCoverageErrors(t *testing.T) {
+	ft := New()
+	require.NoError(t, ft.SetRules([]byte(`{"rules": {".read": "auth.uid === 'a'"}}`)))
+
+	ft.Simulate(nil, "GET", "/", nil)
+	rc := ft.Coverage().Rules[0]
+	assert.Equal(t, int64(1), rc.Hits)
+	assert.Equal(t, int64(1), rc.Errors)
+}
+
+func TestCoverageWriteJSON(t *testing.T) {
+	ft := New()
+	require.NoError(t, ft.SetRules([]byte(testRules)))
+	ft.Simulate(nil, "GET", "/public", nil)
+
+	var buf bytes.Buffer
+	require.NoError(t, ft.Coverage().WriteJSON(&buf))
+
+	var v struct {
+		Source string
+		Rules  []map[string]interface{}
+	}
+	require.NoError(t, json.Unmarshal(buf.Bytes(), &v))
+	assert.Equal(t, testRules, v.Source)
+	require.Len(t, v.Rules, 11)
+	assert.Equal(t, map[string]interface{}{
+		"rule":       "/rules/public/.read",
+		"expression": "true",
+		"line":       6.0,
+		"hits":       1.0,
+		"true":       1.0,
+		"false":      0.0,
+		"errors":     0.0,
+	}, v.Rules[1])
+}
+
+func TestCoverageWriteHTML(t *testing.T) {
+	ft := New()
+	require.NoError(t, ft.SetRules([]byte(testRules)))
+	ft.Simulate(nil, "GET", "/public", nil)
+
+	var buf bytes.Buffer
+	require.NoError(t, ft.Coverage().WriteHTML(&buf))
+	html := buf.String()
+
+	assert.Contains(t, html, "2 of 11 rules evaluated")
+	assert.Contains(t, html, `<tr class="partial" title="/rules/.read: 0 true, 1 false, 0 errors"><td class="line">4</td><td class="hits">1x</td>`)
+	assert.Contains(t, html, `<tr class="covered" title="/rules/public/.read: 1 true, 0 false, 0 errors"><td class="line">6</td>`)
+	assert.Contains(t, html, `<tr class="uncovered" title="/rules/public/.write: 0 true, 0 false, 0 errors"><td class="line">8</td><td class="hits">0x</td>`)
+	assert.Contains(t, html, `<tr class=""><td class="line">7</td><td class="hits"></td><td>      /* but nobody can write */</td></tr>`)
+	assert.Contains(t, html, "auth != null &amp;&amp; auth.uid === $uid")
+	assert.Equal(t, strings.Count(testRules, "\n")+1, strings.Count(html, "<tr"))
+}
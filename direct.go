@@ -1,8 +1,7 @@
 package firetest
 
 import (
-	"encoding/base64"
-	"fmt"
+	"encoding/json"
 	"sync/atomic"
 	"time"
 )
@@ -17,27 +16,125 @@ func (ft *Firetest) RequireAuth(v bool) {
 	atomic.StoreInt32(ft.requireAuth, val)
 }
 
+// SetClock sets the function used to get the current time
+// when resolving server values. Passing nil restores the
+// default of time.Now
+func (ft *Firetest) SetClock(clock func() time.Time) {
+	if clock == nil {
+		clock = time.Now
+	}
+	ft.db.setClock(clock)
+}
+
+// SetRules loads the security rules document enforced on every
+// request that is not authenticated with the secret. Passing nil
+// removes the rules, which grants full access to all requests.
+//
+// Reference https://www.firebase.com/docs/security/guide/
+func (ft *Firetest) SetRules(source []byte) error {
+	var r *rules
+	if source != nil {
+		var err error
+		if r, err = parseRules(source); err != nil {
+			return err
+		}
+	}
+
+	ft.rulesMtx.Lock()
+	ft.rules = r
+	ft.rulesMtx.Unlock()
+	return nil
+}
+
+// SetLimits sets the limits placed on the data written, which
+// default to DefaultLimits. Lowering them makes it
+// possible to test how a client handles the errors returned when
+// they are exceeded.
+func (ft *Firetest) SetLimits(l Limits) {
+	ft.limitsMtx.Lock()
+	ft.limits = l
+	ft.limitsMtx.Unlock()
+}
+
+// SetEventQueue sets how many events are queued for each
+// subscriber to a stream and what happens when a subscriber
+// falls behind and its queue is full. It applies to streams
+// opened after the call. The default is a queue of 1000 events
+// with the OverflowDisconnect policy, so that a stalled client
+// holds up writes for no more than 250 milliseconds.
+func (ft *Firetest) SetEventQueue(size int, policy OverflowPolicy) {
+	ft.db.setQueue(size, policy)
+}
+
+// CancelStreams ends the streams open at the given location
+// with a cancel event, as if they were no longer allowed to
+// read the data.
+func (ft *Firetest) CancelStreams(path string) {
+	ft.db.signal(sanitizePath(path), eventCancel)
+}
+
+// RevokeStreams ends the streams open at the given location
+// with an auth_revoked event, as if their auth token expired.
+func (ft *Firetest) RevokeStreams(path string) {
+	ft.db.signal(sanitizePath(path), eventAuthRevoked)
+}
+
+// SeedPushIDs seeds the random part of the names generated for
+// children created with Create or a POST request. Combined with
+// SetClock this makes the generated names deterministic.
+func (ft *Firetest) SeedPushIDs(seed int64) {
+	ft.pushIDs.seed(seed)
+}
+
+// newName returns a unique name for a child created with Create
+func (ft *Firetest) newName() string {
+	return ft.pushIDs.next(ft.db.now())
+}
+
+// validPath sanitizes path and returns a *PathError
+// if it is not a valid location
+func (ft *Firetest) validPath(path string) (string, error) {
+	path = sanitizePath(path)
+	return path, ft.getLimits().checkPath(path)
+}
+
 // Create generates a new child under the given location
 // using a unique name and returns the name
 //
 // Reference https://www.firebase.com/docs/rest/api/#section-post
-func (ft *Firetest) Create(path string, v interface{}) string {
-	src := []byte(fmt.Sprint(time.Now().UnixNano()))
-	name := "~" + base64.StdEncoding.EncodeToString(src)
+func (ft *Firetest) Create(path string, v interface{}) (string, error) {
+	return ft.createIf(path, v, nil)
+}
 
-	path = fmt.Sprintf("%s/%s", sanitizePath(path), name)
-	// sanitize one more time in case initial path was empty
-	path = sanitizePath(path)
-	ft.db.add(path, newNode(v))
-	return name
+// createIf is Create, but the write is only made if check passes.
+// The generated name is not held to the key length limit.
+func (ft *Firetest) createIf(path string, v interface{}, check writeCheck) (string, error) {
+	path, err := ft.validPath(path)
+	if err != nil {
+		return "", err
+	}
+	if _, ok := priorityPath(path); ok {
+		return "", &PathError{Path: path, Key: priorityKey, Err: ErrInvalidKey}
+	}
+
+	name := ft.newName()
+	path = joinPath(path, name)
+	if err := ft.getLimits().checkData(path, v); err != nil {
+		return "", err
+	}
+	if _, err := ft.db.addIf(path, newNode(v), check); err != nil {
+		return "", err
+	}
+	return name, nil
 }
 
 // Delete removes the data at the requested location.
 // Any data at child locations will also be deleted.
 //
 // Reference https://www.firebase.com/docs/rest/api/#section-delete
-func (ft *Firetest) Delete(path string) {
-	ft.db.del(sanitizePath(path))
+func (ft *Firetest) Delete(path string) error {
+	_, err := ft.setIf(path, nil, nil)
+	return err
 }
 
 // Update writes the enumerated children to this the given location.
@@ -47,32 +144,186 @@ func (ft *Firetest) Delete(path string) {
 // if they are objects. Passing null as a value for a child is equivalent to
 // calling remove() on that child.
 //
+// Keys can be paths such as "users/alice/name" to update deeper locations
+// in a single atomic write, as long as none of them is the same as or
+// an ancestor of another. Data that is not an object, or whose paths
+// overlap, is rejected with a *PathError.
+//
 // Reference https://www.firebase.com/docs/rest/api/#section-patch
-func (ft *Firetest) Update(path string, v interface{}) {
-	path = sanitizePath(path)
-	if v == nil {
-		ft.db.del(path)
-	} else {
-		ft.db.update(path, newNode(v))
+func (ft *Firetest) Update(path string, v interface{}) error {
+	_, err := ft.updateIf(path, v, nil)
+	return err
+}
+
+// updateIf is Update for writes that are only made if check allows
+// them. It returns the data written, with its server values resolved,
+// in the export format so that priorities are included.
+func (ft *Firetest) updateIf(path string, v interface{}, check writeCheck) (interface{}, error) {
+	if _, ok := priorityPath(sanitizePath(path)); ok || v == nil {
+		return ft.setIf(path, v, check)
+	}
+
+	path, err := ft.validPath(path)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := object(v); !ok {
+		return nil, &PathError{Path: path, Err: ErrInvalidUpdate}
 	}
+	if err := ft.getLimits().checkUpdate(path, v); err != nil {
+		return nil, err
+	}
+
+	n, err := newUpdate(path, v)
+	if err != nil {
+		return nil, err
+	}
+	if n, err = ft.db.updateIf(path, n, check); err != nil {
+		return nil, err
+	}
+	if n.isNil() && n.priority != nil {
+		// a node holding only a priority exports as null
+		return map[string]interface{}{priorityKey: n.priority}, nil
+	}
+	return n.export(), nil
 }
 
 // Set writes data to at the given location.
 // This will overwrite any data at this location and all child locations.
+// Setting a path ending in .priority only changes the priority of its parent.
 //
 // Reference https://www.firebase.com/docs/rest/api/#section-put
-func (ft *Firetest) Set(path string, v interface{}) {
-	ft.db.add(sanitizePath(path), newNode(v))
+func (ft *Firetest) Set(path string, v interface{}) error {
+	_, err := ft.setIf(path, v, nil)
+	return err
+}
+
+// setIf is Set for writes that are only made if check allows them.
+// Setting nil deletes the data at the location. It returns the data
+// stored, as Get would, with its server values resolved.
+func (ft *Firetest) setIf(path string, v interface{}, check writeCheck) (interface{}, error) {
+	path, err := ft.validPath(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if p, ok := priorityPath(path); ok {
+		if err := checkPriority(path, v); err != nil {
+			return nil, err
+		}
+
+		n, err := ft.db.setPriorityIf(p, newPriority(v), check)
+		if n == nil {
+			return nil, err
+		}
+		return n.priority, nil
+	}
+	if err := ft.getLimits().checkData(path, v); err != nil {
+		return nil, err
+	}
+
+	n, err := ft.db.addIf(path, newNode(v), check)
+	if err != nil {
+		return nil, err
+	}
+	return n.objectify(), nil
 }
 
 // Get retrieves the data and all its children at the
-// requested location
+// requested location. Getting a path ending in .priority
+// returns the priority of its parent. There is never any
+// data at a location that is not valid.
+//
+// Numbers are returned as a json.Number no matter how they were
+// written, which keeps integers of any size exact. GetInt and
+// GetFloat return them as Go numbers.
 //
 // Reference https://www.firebase.com/docs/rest/api/#section-get
 func (ft *Firetest) Get(path string) (v interface{}) {
-	n := ft.db.get(sanitizePath(path))
+	path, err := ft.validPath(path)
+	if err != nil {
+		return nil
+	}
+
+	if p, ok := priorityPath(path); ok {
+		if n := ft.db.get(p); n != nil {
+			v = n.priority
+		}
+		return v
+	}
+
+	n := ft.db.get(path)
 	if n != nil {
 		v = n.objectify()
 	}
 	return v
 }
+
+// GetInt returns the number at the given location as an int64.
+// It reports false if there is no integer that fits in an int64
+// at the location.
+func (ft *Firetest) GetInt(path string) (int64, bool) {
+	return toInt(ft.Get(path))
+}
+
+// GetFloat returns the number at the given location as a float64.
+// It reports false if there is no number at the location.
+func (ft *Firetest) GetFloat(path string) (float64, bool) {
+	n, ok := ft.Get(path).(json.Number)
+	if !ok {
+		return 0, false
+	}
+
+	f, err := n.Float64()
+	return f, err == nil
+}
+
+// GetString returns the string at the given location.
+// It reports false if there is no string at the location.
+func (ft *Firetest) GetString(path string) (string, bool) {
+	s, ok := ft.Get(path).(string)
+	return s, ok
+}
+
+// GetBool returns the boolean at the given location.
+// It reports false if there is no boolean at the location.
+func (ft *Firetest) GetBool(path string) (bool, bool) {
+	b, ok := ft.Get(path).(bool)
+	return b, ok
+}
+
+// maxTransactionRetries is how many times a transaction is attempted
+// before giving up because the data keeps changing while it runs
+const maxTransactionRetries = 25
+
+// Transaction atomically replaces the data at the given location.
+// update is called with the current data, as returned by Get, and
+// returns the new data, or false to abort. If the data changes before
+// the new data is stored, update is called again with the latest data.
+// Transaction returns the data at the location once it is done and
+// whether the new data was stored, which it never is for a location
+// that is not valid or new data that breaks the limits.
+func (ft *Firetest) Transaction(path string, update func(current interface{}) (interface{}, bool)) (interface{}, bool) {
+	path, err := ft.validPath(path)
+	if err != nil {
+		return nil, false
+	}
+	if _, ok := priorityPath(path); ok {
+		return nil, false
+	}
+
+	current := ft.db.get(path)
+	for i := 0; i < maxTransactionRetries; i++ {
+		v, ok := update(current.objectify())
+		if !ok || ft.getLimits().checkData(path, v) != nil {
+			return current.objectify(), false
+		}
+
+		n, err := ft.db.addIf(path, newNode(v), ifMatch(current.etag(), nil))
+		if err == nil {
+			return n.objectify(), true
+		}
+		current = ft.db.get(path)
+	}
+	return current.objectify(), false
+}
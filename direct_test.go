@@ -1,9 +1,12 @@
 package firetest
 
 import (
+	"encoding/json"
 	"strings"
+	"sync"
 	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -27,8 +30,9 @@ func TestCreate(t *testing.T) {
 	)
 
 	for _, p := range []string{"path/hi", ""} {
-		name := ft.Create(p, v)
-		assert.True(t, strings.HasPrefix(name, "~"), "name is missing `~` prefix")
+		name, err := ft.Create(p, v)
+		assert.NoError(t, err)
+		assert.Len(t, name, 20)
 
 		n := ft.db.get(sanitizePath(p + "/" + name))
 		assert.Equal(t, v, n.value)
@@ -43,12 +47,12 @@ func TestDelete(t *testing.T) {
 	)
 
 	// delete path directly
-	ft.db.add(path, newNode(v))
+	ft.db.addIf(path, newNode(v), nil)
 	ft.Delete(path)
 	assert.Nil(t, ft.db.get(path))
 
 	// delete parent
-	ft.db.add(path, newNode(v))
+	ft.db.addIf(path, newNode(v), nil)
 	ft.Delete("foo")
 	assert.Nil(t, ft.db.get(path))
 }
@@ -63,7 +67,7 @@ func TestUpdate(t *testing.T) {
 			"3": "three",
 		}
 	)
-	ft.db.add(path, newNode(v))
+	ft.db.addIf(path, newNode(v), nil)
 
 	ft.Update(path, map[string]string{
 		"1": "three",
@@ -76,6 +80,129 @@ func TestUpdate(t *testing.T) {
 	assert.Equal(t, "one", three.value)
 }
 
+func TestUpdatePaths(t *testing.T) {
+	ft := New()
+	ft.Set("users/alice", map[string]interface{}{"name": "Alice", "age": 30})
+
+	err := ft.Update("", map[string]interface{}{
+		"users/alice/name": "Alicia",
+		"/users/bob/name/": "Bob",
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]interface{}{
+		"alice": map[string]interface{}{"name": "Alicia", "age": json.Number("30")},
+		"bob":   map[string]interface{}{"name": "Bob"},
+	}, ft.Get("users"))
+
+	err = ft.Update("users", map[string]interface{}{
+		"alice":      nil,
+		"alice/name": "Alice",
+	})
+	assert.Equal(t, &PathError{Path: "users/alice/name", Err: ErrOverlappingPaths}, err)
+	assert.Equal(t, "Alicia", ft.Get("users/alice/name"), "a rejected update should not write anything")
+
+	err = ft.Update("", map[string]string{"users/carol/name": "Carol"})
+	assert.NoError(t, err)
+	assert.Equal(t, "Carol", ft.Get("users/carol/name"))
+
+	for _, key := range []string{"", "/", "//"} {
+		err = ft.Update("", map[string]interface{}{key: "x"})
+		assert.Equal(t, &PathError{Key: key, Err: ErrEmptyKey}, err, "%q", key)
+	}
+	assert.Equal(t, "Alicia", ft.Get("users/alice/name"), "a rejected update should not write anything")
+}
+
+func TestInvalidPaths(t *testing.T) {
+	ft := New()
+
+	for _, test := range []struct {
+		path string
+		err  error
+	}{
+		{"foo//bar", ErrEmptyKey},
+		{"foo/b.r", ErrInvalidKey},
+		{"$foo", ErrInvalidKey},
+		{"foo/" + strings.Repeat("a", 769), ErrKeyTooLong},
+		{strings.Repeat("a/", 33), ErrTooDeep},
+	} {
+		for _, err := range []error{
+			ft.Set(test.path, 1),
+			ft.Update(test.path, map[string]interface{}{"a": 1}),
+			ft.Delete(test.path),
+		} {
+			if assert.IsType(t, &PathError{}, err, test.path) {
+				assert.Equal(t, test.err, err.(*PathError).Err, test.path)
+			}
+		}
+
+		name, err := ft.Create(test.path, 1)
+		assert.Empty(t, name)
+		assert.IsType(t, &PathError{}, err, test.path)
+		assert.Nil(t, ft.Get(test.path), test.path)
+	}
+	assert.Nil(t, ft.Get(""))
+
+	err := ft.Set("foo", map[string]interface{}{"bar": map[string]interface{}{"b[a]z": 1}})
+	assert.Equal(t, &PathError{Path: "foo/bar/b[a]z", Key: "b[a]z", Err: ErrInvalidKey}, err)
+	err = ft.Update("foo", map[string]interface{}{"bar/.baz": 1})
+	assert.Equal(t, &PathError{Path: "foo/bar/.baz", Key: ".baz", Err: ErrInvalidKey}, err)
+	_, err = ft.Create("foo", map[string]interface{}{"#": 1})
+	assert.IsType(t, &PathError{}, err)
+	assert.Nil(t, ft.Get("foo"))
+
+	assert.NoError(t, ft.Set("ünï/cödé", "✓"))
+	assert.Equal(t, map[string]interface{}{"cödé": "✓"}, ft.Get("ünï"))
+}
+
+func TestUnsupportedTypes(t *testing.T) {
+	ft := New()
+
+	for _, v := range []interface{}{
+		struct{}{},
+		[]string{"a"},
+		map[string]int{"a": 1},
+		map[string]interface{}{"a": map[string]interface{}{"b": func() {}}},
+	} {
+		assert.IsType(t, &TypeError{}, ft.Set("x", v), "%v", v)
+		assert.IsType(t, &TypeError{}, ft.Update("", map[string]interface{}{"x/y": v}), "%v", v)
+		_, err := ft.Create("x", v)
+		assert.IsType(t, &TypeError{}, err, "%v", v)
+		_, err = ft.Simulate(nil, "PUT", "x", v)
+		assert.IsType(t, &TypeError{}, err, "%v", v)
+		_, ok := ft.Transaction("x", func(interface{}) (interface{}, bool) { return v, true })
+		assert.False(t, ok, "%v", v)
+		assert.Nil(t, ft.Get(""), "%v", v)
+	}
+}
+
+func TestNullWrites(t *testing.T) {
+	ft := New()
+
+	for _, v := range []interface{}{
+		nil,
+		map[string]interface{}{},
+		map[string]interface{}{"c": nil},
+		map[string]interface{}{"c": map[string]interface{}{"d": nil}},
+		[]interface{}{nil, nil},
+	} {
+		ft.Set("a/b", 1)
+		ft.Set("a/x/y", 2)
+
+		assert.NoError(t, ft.Set("a/x/y", v))
+		assert.Equal(t, map[string]interface{}{"b": json.Number("1")}, ft.Get("a"), "%v", v)
+		assert.NoError(t, ft.Set("a/b", v))
+		assert.Nil(t, ft.Get(""), "%v: empty parents should be pruned", v)
+	}
+
+	ft.Set("a", map[string]interface{}{"b": 1, "c": 2})
+	assert.NoError(t, ft.Update("a", map[string]interface{}{"b": map[string]interface{}{"x": nil}, "c": nil}))
+	assert.Nil(t, ft.Get(""))
+
+	_, err := ft.Create("list", map[string]interface{}{"a": nil})
+	assert.NoError(t, err)
+	assert.Nil(t, ft.Get(""))
+}
+
 func TestUpdateNil(t *testing.T) {
 	var (
 		ft   = New()
@@ -86,7 +213,7 @@ func TestUpdateNil(t *testing.T) {
 			"3": "three",
 		}
 	)
-	ft.db.add(path, newNode(v))
+	ft.db.addIf(path, newNode(v), nil)
 
 	ft.Update(path, nil)
 	assert.Nil(t, ft.db.get(path))
@@ -95,6 +222,17 @@ func TestUpdateNil(t *testing.T) {
 	assert.Nil(t, ft.db.get(path+"/3"))
 }
 
+func TestUpdateNotObject(t *testing.T) {
+	ft := New()
+	ft.Set("foo", "bar")
+
+	for _, v := range []interface{}{5, "baz", []interface{}{1, 2}} {
+		err := ft.Update("foo", v)
+		assert.Equal(t, &PathError{Path: "foo", Err: ErrInvalidUpdate}, err, "%v", v)
+	}
+	assert.Equal(t, "bar", ft.Get("foo"), "a rejected update should not write anything")
+}
+
 func TestSet(t *testing.T) {
 	var (
 		ft   = New()
@@ -113,8 +251,193 @@ func TestGet(t *testing.T) {
 		path = "foo/bar"
 		v    = true
 	)
-	ft.db.add(path, newNode(v))
+	ft.db.addIf(path, newNode(v), nil)
 
 	val := ft.Get(path)
 	assert.Equal(t, v, val)
 }
+
+func TestGetTyped(t *testing.T) {
+	ft := New()
+	ft.Set("", map[string]interface{}{
+		"big":     json.Number("9007199254740993"),
+		"decimal": 2.5,
+		"integer": 3.0,
+		"string":  "foo",
+		"bool":    true,
+	})
+
+	assert.Equal(t, json.Number("9007199254740993"), ft.Get("big"))
+	assert.Equal(t, json.Number("3"), ft.Get("integer"))
+
+	i, ok := ft.GetInt("big")
+	assert.True(t, ok)
+	assert.Equal(t, int64(9007199254740993), i)
+	i, ok = ft.GetInt("integer")
+	assert.True(t, ok)
+	assert.Equal(t, int64(3), i)
+	_, ok = ft.GetInt("decimal")
+	assert.False(t, ok)
+
+	f, ok := ft.GetFloat("decimal")
+	assert.True(t, ok)
+	assert.Equal(t, 2.5, f)
+	_, ok = ft.GetFloat("string")
+	assert.False(t, ok)
+
+	s, ok := ft.GetString("string")
+	assert.True(t, ok)
+	assert.Equal(t, "foo", s)
+	_, ok = ft.GetString("big")
+	assert.False(t, ok)
+
+	b, ok := ft.GetBool("bool")
+	assert.True(t, ok)
+	assert.True(t, b)
+	_, ok = ft.GetBool("missing")
+	assert.False(t, ok)
+}
+
+func TestPriority(t *testing.T) {
+	var (
+		ft   = New()
+		path = "foo/bar"
+	)
+
+	// priorities are not stored on empty locations
+	ft.Set(path+"/.priority", 1)
+	assert.Nil(t, ft.Get(path+"/.priority"))
+
+	ft.Set(path, map[string]interface{}{"baz": true, ".priority": 1})
+	assert.Equal(t, json.Number("1"), ft.Get(path+"/.priority"))
+	assert.Equal(t, map[string]interface{}{"baz": true}, ft.Get(path))
+
+	ft.Set(path+"/.priority", "a")
+	assert.Equal(t, "a", ft.Get(path+"/.priority"))
+
+	// invalid priorities are rejected, not cleared
+	for _, v := range []interface{}{true, map[string]interface{}{"x": 1}, []interface{}{1}} {
+		err := ft.Set(path+"/.priority", v)
+		assert.Equal(t, &PathError{Path: path + "/.priority", Err: ErrInvalidPriority}, err, "%v", v)
+	}
+	assert.Equal(t, "a", ft.Get(path+"/.priority"))
+
+	// updates leave the priority untouched
+	ft.Update(path, map[string]interface{}{"qux": false})
+	assert.Equal(t, "a", ft.Get(path+"/.priority"))
+
+	ft.Delete(path + "/.priority")
+	assert.Nil(t, ft.Get(path+"/.priority"))
+	assert.Equal(t, map[string]interface{}{"baz": true, "qux": false}, ft.Get(path))
+
+	// set replaces the priority along with the data
+	ft.Set(path, map[string]interface{}{"baz": true, ".priority": 1})
+	ft.Set(path, map[string]interface{}{"baz": true})
+	assert.Nil(t, ft.Get(path+"/.priority"))
+}
+
+func TestSetClock(t *testing.T) {
+	var (
+		ft   = New()
+		path = "foo/bar"
+		now  = time.Unix(1437139539, 0)
+	)
+
+	ft.SetClock(func() time.Time { return now })
+	ft.Set(path, map[string]interface{}{".sv": "timestamp"})
+	assert.Equal(t, json.Number("1437139539000"), ft.Get(path))
+
+	ft.SetClock(nil)
+	ft.Set(path, map[string]string{".sv": "timestamp"})
+	assert.NotEqual(t, json.Number("1437139539000"), ft.Get(path))
+}
+
+func TestSetRules(t *testing.T) {
+	ft := New()
+	assert.Error(t, ft.SetRules([]byte(`{"rules": {".read": "("}}`)))
+	assert.Nil(t, ft.getRules())
+
+	assert.NoError(t, ft.SetRules([]byte(`{"rules": {".read": true}}`)))
+	assert.NotNil(t, ft.getRules())
+
+	assert.NoError(t, ft.SetRules(nil))
+	assert.Nil(t, ft.getRules())
+}
+
+func TestCreateBefore1970(t *testing.T) {
+	ft := New()
+	ft.SetClock(func() time.Time { return time.Time{} })
+
+	name, err := ft.Create("p", 1)
+	assert.NoError(t, err)
+	assert.Equal(t, "--------", name[:8])
+}
+
+func TestSeedPushIDs(t *testing.T) {
+	names := func() []string {
+		ft := New()
+		ft.SetClock(func() time.Time { return time.Unix(1437139539, 0) })
+		ft.SeedPushIDs(42)
+		first, _ := ft.Create("foo", 1)
+		second, _ := ft.Create("foo", 2)
+		return []string{first, second}
+	}
+
+	first := names()
+	assert.Equal(t, first, names())
+	assert.Equal(t, "-JuRBGFs", first[0][:8])
+	assert.True(t, first[0] < first[1])
+}
+
+func TestTransaction(t *testing.T) {
+	ft := New()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				_, ok := ft.Transaction("counter", func(current interface{}) (interface{}, bool) {
+					n, _ := toInt(current)
+					return n + 1, true
+				})
+				assert.True(t, ok)
+			}
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, json.Number("200"), ft.Get("counter"))
+}
+
+func TestTransactionAbort(t *testing.T) {
+	ft := New()
+	ft.Set("stock", 0)
+
+	v, ok := ft.Transaction("stock", func(current interface{}) (interface{}, bool) {
+		n, _ := toInt(current)
+		return n - 1, n > 0
+	})
+	assert.False(t, ok)
+	assert.Equal(t, json.Number("0"), v)
+	assert.Equal(t, json.Number("0"), ft.Get("stock"))
+}
+
+func TestTransactionRetry(t *testing.T) {
+	ft := New()
+	ft.Set("foo", 1)
+
+	var calls int
+	v, ok := ft.Transaction("foo", func(current interface{}) (interface{}, bool) {
+		calls++
+		if calls == 1 {
+			// change the data while the transaction runs
+			ft.Set("foo", 10)
+		}
+		n, _ := toInt(current)
+		return n + 1, true
+	})
+	assert.True(t, ok)
+	assert.Equal(t, 2, calls)
+	assert.Equal(t, json.Number("11"), v)
+}
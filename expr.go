@@ -0,0 +1,768 @@
+package firetest
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// This file implements the expression language used by
+// security rules, which is a small subset of JavaScript.
+//
+// Reference https://www.firebase.com/docs/security/api/
+
+var errNullProperty = errors.New("cannot read property of null")
+
+type tokenKind int
+
+const (
+	tokEOF tokenKind = iota
+	tokNumber
+	tokString
+	tokIdent
+	tokRegexp
+	tokPunct
+)
+
+type token struct {
+	kind tokenKind
+	text string
+	pos  int
+}
+
+// punctuators ordered so that longer operators are matched first
+var punctuators = []string{
+	"===", "!==",
+	"==", "!=", "<=", ">=", "&&", "||",
+	"(", ")", "[", "]", ",", ".", "!", "?", ":",
+	"+", "-", "*", "/", "%", "<", ">",
+}
+
+type lexer struct {
+	src    string
+	pos    int
+	tokens []token
+}
+
+func tokenize(src string) ([]token, error) {
+	l := &lexer{src: src}
+	for {
+		tok, err := l.next()
+		if err != nil {
+			return nil, err
+		}
+		l.tokens = append(l.tokens, tok)
+		if tok.kind == tokEOF {
+			return l.tokens, nil
+		}
+	}
+}
+
+func (l *lexer) next() (token, error) {
+	for l.pos < len(l.src) && strings.IndexByte(" \t\r\n", l.src[l.pos]) >= 0 {
+		l.pos++
+	}
+	if l.pos >= len(l.src) {
+		return token{kind: tokEOF, pos: l.pos}, nil
+	}
+
+	start := l.pos
+	c := l.src[l.pos]
+	switch {
+	case isIdentStart(c):
+		for l.pos < len(l.src) && isIdentPart(l.src[l.pos]) {
+			l.pos++
+		}
+		return token{kind: tokIdent, text: l.src[start:l.pos], pos: start}, nil
+	case c >= '0' && c <= '9':
+		for l.pos < len(l.src) && (isDigit(l.src[l.pos]) || l.src[l.pos] == '.') {
+			l.pos++
+		}
+		return token{kind: tokNumber, text: l.src[start:l.pos], pos: start}, nil
+	case c == '\'' || c == '"':
+		s, err := l.readString(c)
+		return token{kind: tokString, text: s, pos: start}, err
+	case c == '/' && !l.afterOperand():
+		return l.readRegexp()
+	}
+
+	for _, p := range punctuators {
+		if strings.HasPrefix(l.src[l.pos:], p) {
+			l.pos += len(p)
+			return token{kind: tokPunct, text: p, pos: start}, nil
+		}
+	}
+	return token{}, fmt.Errorf("unexpected character %q at position %d", c, start)
+}
+
+// afterOperand reports whether the previous token ends an
+// operand, in which case a slash is a division operator.
+func (l *lexer) afterOperand() bool {
+	if len(l.tokens) == 0 {
+		return false
+	}
+
+	prev := l.tokens[len(l.tokens)-1]
+	switch prev.kind {
+	case tokNumber, tokString, tokIdent, tokRegexp:
+		return true
+	}
+	return prev.text == ")" || prev.text == "]"
+}
+
+func (l *lexer) readString(quote byte) (string, error) {
+	start := l.pos
+	l.pos++ // opening quote
+
+	var s []byte
+	for l.pos < len(l.src) {
+		c := l.src[l.pos]
+		switch c {
+		case quote:
+			l.pos++
+			return string(s), nil
+		case '\\':
+			l.pos++
+			if l.pos >= len(l.src) {
+				break
+			}
+			switch e := l.src[l.pos]; e {
+			case 'n':
+				s = append(s, '\n')
+			case 't':
+				s = append(s, '\t')
+			case 'r':
+				s = append(s, '\r')
+			default:
+				s = append(s, e)
+			}
+		default:
+			s = append(s, c)
+		}
+		l.pos++
+	}
+	return "", fmt.Errorf("unterminated string at position %d", start)
+}
+
+func (l *lexer) readRegexp() (token, error) {
+	start := l.pos
+	l.pos++ // opening slash
+
+	var pattern []byte
+	for {
+		if l.pos >= len(l.src) {
+			return token{}, fmt.Errorf("unterminated regular expression at position %d", start)
+		}
+
+		c := l.src[l.pos]
+		l.pos++
+		if c == '/' {
+			break
+		}
+		pattern = append(pattern, c)
+		if c == '\\' && l.pos < len(l.src) {
+			pattern = append(pattern, l.src[l.pos])
+			l.pos++
+		}
+	}
+
+	flags := l.pos
+	for l.pos < len(l.src) && isIdentPart(l.src[l.pos]) {
+		l.pos++
+	}
+	text := string(pattern)
+	switch l.src[flags:l.pos] {
+	case "":
+	case "i":
+		text = "(?i)" + text
+	default:
+		return token{}, fmt.Errorf("unsupported regular expression flags %q", l.src[flags:l.pos])
+	}
+	return token{kind: tokRegexp, text: text, pos: start}, nil
+}
+
+func isDigit(c byte) bool      { return c >= '0' && c <= '9' }
+func isIdentStart(c byte) bool { return c == '_' || c == '$' || (c|0x20 >= 'a' && c|0x20 <= 'z') }
+func isIdentPart(c byte) bool  { return isIdentStart(c) || isDigit(c) }
+
+// expr is a node of a parsed rule expression
+type expr interface {
+	eval(env *ruleEnv) (interface{}, error)
+}
+
+type (
+	literalExpr struct{ value interface{} }
+	identExpr   struct{ name string }
+	arrayExpr   struct{ elems []expr }
+	memberExpr  struct {
+		object expr
+		name   string
+	}
+	indexExpr struct {
+		object expr
+		index  expr
+	}
+	callExpr struct {
+		fn   expr
+		args []expr
+	}
+	unaryExpr struct {
+		op string
+		x  expr
+	}
+	binaryExpr struct {
+		op          string
+		left, right expr
+	}
+	ternaryExpr struct {
+		cond, then, els expr
+	}
+)
+
+// ruleFunc is a method bound to a value, such as data.child
+type ruleFunc func(args []interface{}) (interface{}, error)
+
+// binaryPrecedence lists the binary operators from the
+// loosest to the tightest binding.
+var binaryPrecedence = [][]string{
+	{"||"},
+	{"&&"},
+	{"==", "!=", "===", "!=="},
+	{"<", "<=", ">", ">="},
+	{"+", "-"},
+	{"*", "/", "%"},
+}
+
+type parser struct {
+	tokens []token
+	pos    int
+}
+
+// parseExpr compiles the source of a rule expression.
+func parseExpr(src string) (expr, error) {
+	tokens, err := tokenize(src)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &parser{tokens: tokens}
+	e, err := p.ternary()
+	if err != nil {
+		return nil, err
+	}
+	if tok := p.peek(); tok.kind != tokEOF {
+		return nil, fmt.Errorf("unexpected %q at position %d", tok.text, tok.pos)
+	}
+	return e, nil
+}
+
+func (p *parser) peek() token { return p.tokens[p.pos] }
+
+func (p *parser) accept(punct string) bool {
+	if tok := p.peek(); tok.kind == tokPunct && tok.text == punct {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *parser) expect(punct string) error {
+	if !p.accept(punct) {
+		tok := p.peek()
+		return fmt.Errorf("expected %q at position %d", punct, tok.pos)
+	}
+	return nil
+}
+
+func (p *parser) ternary() (expr, error) {
+	cond, err := p.binary(0)
+	if err != nil || !p.accept("?") {
+		return cond, err
+	}
+
+	then, err := p.ternary()
+	if err != nil {
+		return nil, err
+	}
+	if err := p.expect(":"); err != nil {
+		return nil, err
+	}
+	els, err := p.ternary()
+	if err != nil {
+		return nil, err
+	}
+	return ternaryExpr{cond: cond, then: then, els: els}, nil
+}
+
+func (p *parser) binary(level int) (expr, error) {
+	if level == len(binaryPrecedence) {
+		return p.unary()
+	}
+
+	left, err := p.binary(level + 1)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		op, ok := p.binaryOperator(level)
+		if !ok {
+			return left, nil
+		}
+
+		right, err := p.binary(level + 1)
+		if err != nil {
+			return nil, err
+		}
+		left = binaryExpr{op: op, left: left, right: right}
+	}
+}
+
+func (p *parser) binaryOperator(level int) (string, bool) {
+	for _, op := range binaryPrecedence[level] {
+		if p.accept(op) {
+			return op, true
+		}
+	}
+	return "", false
+}
+
+func (p *parser) unary() (expr, error) {
+	for _, op := range []string{"!", "-"} {
+		if p.accept(op) {
+			x, err := p.unary()
+			if err != nil {
+				return nil, err
+			}
+			return unaryExpr{op: op, x: x}, nil
+		}
+	}
+	return p.postfix()
+}
+
+func (p *parser) postfix() (expr, error) {
+	e, err := p.primary()
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		switch {
+		case p.accept("."):
+			tok := p.peek()
+			if tok.kind != tokIdent {
+				return nil, fmt.Errorf("expected property name at position %d", tok.pos)
+			}
+			p.pos++
+			e = memberExpr{object: e, name: tok.text}
+		case p.accept("["):
+			index, err := p.ternary()
+			if err != nil {
+				return nil, err
+			}
+			if err := p.expect("]"); err != nil {
+				return nil, err
+			}
+			e = indexExpr{object: e, index: index}
+		case p.accept("("):
+			args, err := p.list(")")
+			if err != nil {
+				return nil, err
+			}
+			e = callExpr{fn: e, args: args}
+		default:
+			return e, nil
+		}
+	}
+}
+
+// list parses comma separated expressions up to the closing punctuator.
+func (p *parser) list(closing string) ([]expr, error) {
+	var elems []expr
+	if p.accept(closing) {
+		return elems, nil
+	}
+
+	for {
+		e, err := p.ternary()
+		if err != nil {
+			return nil, err
+		}
+		elems = append(elems, e)
+
+		if p.accept(closing) {
+			return elems, nil
+		}
+		if err := p.expect(","); err != nil {
+			return nil, err
+		}
+	}
+}
+
+func (p *parser) primary() (expr, error) {
+	tok := p.peek()
+	p.pos++
+
+	switch tok.kind {
+	case tokNumber:
+		f, err := strconv.ParseFloat(tok.text, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid number %q at position %d", tok.text, tok.pos)
+		}
+		return literalExpr{value: f}, nil
+	case tokString:
+		return literalExpr{value: tok.text}, nil
+	case tokRegexp:
+		re, err := regexp.Compile(tok.text)
+		if err != nil {
+			return nil, fmt.Errorf("invalid regular expression at position %d: %v", tok.pos, err)
+		}
+		return literalExpr{value: re}, nil
+	case tokIdent:
+		switch tok.text {
+		case "true":
+			return literalExpr{value: true}, nil
+		case "false":
+			return literalExpr{value: false}, nil
+		case "null":
+			return literalExpr{value: nil}, nil
+		}
+		return identExpr{name: tok.text}, nil
+	case tokPunct:
+		switch tok.text {
+		case "(":
+			e, err := p.ternary()
+			if err != nil {
+				return nil, err
+			}
+			return e, p.expect(")")
+		case "[":
+			elems, err := p.list("]")
+			if err != nil {
+				return nil, err
+			}
+			return arrayExpr{elems: elems}, nil
+		}
+	case tokEOF:
+		return nil, errors.New("unexpected end of expression")
+	}
+	return nil, fmt.Errorf("unexpected %q at position %d", tok.text, tok.pos)
+}
+
+func (e literalExpr) eval(env *ruleEnv) (interface{}, error) { return e.value, nil }
+
+func (e identExpr) eval(env *ruleEnv) (interface{}, error) { return env.lookup(e.name) }
+
+func (e arrayExpr) eval(env *ruleEnv) (interface{}, error) {
+	values := make([]interface{}, len(e.elems))
+	for i, elem := range e.elems {
+		v, err := elem.eval(env)
+		if err != nil {
+			return nil, err
+		}
+		values[i] = v
+	}
+	return values, nil
+}
+
+func (e memberExpr) eval(env *ruleEnv) (interface{}, error) {
+	obj, err := e.object.eval(env)
+	if err != nil {
+		return nil, err
+	}
+	return property(obj, e.name)
+}
+
+func (e indexExpr) eval(env *ruleEnv) (interface{}, error) {
+	obj, err := e.object.eval(env)
+	if err != nil {
+		return nil, err
+	}
+	index, err := e.index.eval(env)
+	if err != nil {
+		return nil, err
+	}
+
+	name, ok := index.(string)
+	if !ok {
+		return nil, fmt.Errorf("invalid property %v", index)
+	}
+	return property(obj, name)
+}
+
+func (e callExpr) eval(env *ruleEnv) (interface{}, error) {
+	v, err := e.fn.eval(env)
+	if err != nil {
+		return nil, err
+	}
+	fn, ok := v.(ruleFunc)
+	if !ok {
+		return nil, errors.New("value is not a function")
+	}
+
+	args := make([]interface{}, len(e.args))
+	for i, arg := range e.args {
+		if args[i], err = arg.eval(env); err != nil {
+			return nil, err
+		}
+	}
+	return fn(args)
+}
+
+func (e unaryExpr) eval(env *ruleEnv) (interface{}, error) {
+	x, err := e.x.eval(env)
+	if err != nil {
+		return nil, err
+	}
+
+	switch e.op {
+	case "!":
+		b, ok := x.(bool)
+		if !ok {
+			return nil, fmt.Errorf("operand of ! must be a boolean")
+		}
+		return !b, nil
+	default:
+		if !isNumber(x) {
+			return nil, fmt.Errorf("operand of - must be a number")
+		}
+		return -toFloat(x), nil
+	}
+}
+
+func (e binaryExpr) eval(env *ruleEnv) (interface{}, error) {
+	left, err := e.left.eval(env)
+	if err != nil {
+		return nil, err
+	}
+
+	// short circuit the logical operators
+	if e.op == "&&" || e.op == "||" {
+		l, ok := left.(bool)
+		if !ok {
+			return nil, fmt.Errorf("left operand of %s must be a boolean", e.op)
+		}
+		if l == (e.op == "||") {
+			return l, nil
+		}
+
+		right, err := e.right.eval(env)
+		if err != nil {
+			return nil, err
+		}
+		r, ok := right.(bool)
+		if !ok {
+			return nil, fmt.Errorf("right operand of %s must be a boolean", e.op)
+		}
+		return r, nil
+	}
+
+	right, err := e.right.eval(env)
+	if err != nil {
+		return nil, err
+	}
+
+	switch e.op {
+	case "==", "===":
+		return ruleEquals(left, right), nil
+	case "!=", "!==":
+		return !ruleEquals(left, right), nil
+	case "+":
+		if ls, ok := left.(string); ok {
+			return ls + ruleString(right), nil
+		}
+		if rs, ok := right.(string); ok {
+			return ruleString(left) + rs, nil
+		}
+	case "<", "<=", ">", ">=":
+		return compareOperands(e.op, left, right)
+	}
+
+	if !isNumber(left) || !isNumber(right) {
+		return nil, fmt.Errorf("operands of %s must be numbers", e.op)
+	}
+	l, r := toFloat(left), toFloat(right)
+	switch e.op {
+	case "+":
+		return l + r, nil
+	case "-":
+		return l - r, nil
+	case "*":
+		return l * r, nil
+	case "/":
+		return l / r, nil
+	}
+
+	if r == 0 {
+		return nil, errors.New("modulo by zero")
+	}
+	// like in JavaScript, the result has the sign of the dividend
+	return math.Mod(l, r), nil
+}
+
+func compareOperands(op string, left, right interface{}) (interface{}, error) {
+	var c int
+	switch {
+	case isNumber(left) && isNumber(right):
+		l, r := toFloat(left), toFloat(right)
+		switch {
+		case l < r:
+			c = -1
+		case l > r:
+			c = 1
+		}
+	default:
+		l, lok := left.(string)
+		r, rok := right.(string)
+		if !lok || !rok {
+			return nil, fmt.Errorf("operands of %s must both be numbers or strings", op)
+		}
+		c = strings.Compare(l, r)
+	}
+
+	switch op {
+	case "<":
+		return c < 0, nil
+	case "<=":
+		return c <= 0, nil
+	case ">":
+		return c > 0, nil
+	}
+	return c >= 0, nil
+}
+
+func (e ternaryExpr) eval(env *ruleEnv) (interface{}, error) {
+	cond, err := e.cond.eval(env)
+	if err != nil {
+		return nil, err
+	}
+
+	b, ok := cond.(bool)
+	if !ok {
+		return nil, errors.New("condition of ?: must be a boolean")
+	}
+	if b {
+		return e.then.eval(env)
+	}
+	return e.els.eval(env)
+}
+
+// ruleEquals compares two values with strict equality.
+func ruleEquals(a, b interface{}) bool {
+	if isNumber(a) && isNumber(b) {
+		return toFloat(a) == toFloat(b)
+	}
+
+	switch a := a.(type) {
+	case nil:
+		return b == nil
+	case bool:
+		b, ok := b.(bool)
+		return ok && a == b
+	case string:
+		b, ok := b.(string)
+		return ok && a == b
+	}
+	return false
+}
+
+func ruleString(v interface{}) string {
+	switch v := v.(type) {
+	case nil:
+		return "null"
+	case string:
+		return v
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	}
+	return fmt.Sprint(v)
+}
+
+// property returns the named property of a value available
+// to rule expressions.
+func property(obj interface{}, name string) (interface{}, error) {
+	switch obj := obj.(type) {
+	case nil:
+		return nil, errNullProperty
+	case snapshot:
+		if fn, ok := obj.method(name); ok {
+			return fn, nil
+		}
+	case string:
+		if name == "length" {
+			return float64(utf8.RuneCountInString(obj)), nil
+		}
+		if fn, ok := stringMethod(obj, name); ok {
+			return fn, nil
+		}
+	case map[string]interface{}:
+		return obj[name], nil
+	}
+	return nil, fmt.Errorf("no such property %q", name)
+}
+
+func stringMethod(s, name string) (ruleFunc, bool) {
+	var fn ruleFunc
+	switch name {
+	case "contains", "beginsWith", "endsWith":
+		fn = func(args []interface{}) (interface{}, error) {
+			sub, err := stringArg(name, args, 0)
+			if err != nil {
+				return nil, err
+			}
+
+			switch name {
+			case "contains":
+				return strings.Contains(s, sub), nil
+			case "beginsWith":
+				return strings.HasPrefix(s, sub), nil
+			}
+			return strings.HasSuffix(s, sub), nil
+		}
+	case "replace":
+		fn = func(args []interface{}) (interface{}, error) {
+			old, err := stringArg(name, args, 0)
+			if err != nil {
+				return nil, err
+			}
+			replacement, err := stringArg(name, args, 1)
+			if err != nil {
+				return nil, err
+			}
+			return strings.Replace(s, old, replacement, -1), nil
+		}
+	case "toLowerCase":
+		fn = func([]interface{}) (interface{}, error) { return strings.ToLower(s), nil }
+	case "toUpperCase":
+		fn = func([]interface{}) (interface{}, error) { return strings.ToUpper(s), nil }
+	case "matches":
+		fn = func(args []interface{}) (interface{}, error) {
+			if len(args) == 0 {
+				return nil, errors.New("matches requires a regular expression")
+			}
+			re, ok := args[0].(*regexp.Regexp)
+			if !ok {
+				return nil, errors.New("matches requires a regular expression")
+			}
+			return re.MatchString(s), nil
+		}
+	default:
+		return nil, false
+	}
+	return fn, true
+}
+
+func stringArg(method string, args []interface{}, i int) (string, error) {
+	if i >= len(args) {
+		return "", fmt.Errorf("%s requires %d arguments", method, i+1)
+	}
+
+	s, ok := args[i].(string)
+	if !ok {
+		return "", fmt.Errorf("argument %d of %s must be a string", i+1, method)
+	}
+	return s, nil
+}
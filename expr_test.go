@@ -0,0 +1,158 @@
+package firetest
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseExprErrors(t *testing.T) {
+	for _, src := range []string{
+		"",
+		"auth.",
+		"(true",
+		"true false",
+		"'unterminated",
+		"a.matches(/unterminated)",
+		"a.matches(/foo/g)",
+		"a.matches(/(/)",
+		"1 +",
+		"a ? b",
+		"#",
+	} {
+		_, err := parseExpr(src)
+		assert.Error(t, err, src)
+	}
+}
+
+func TestExprEval(t *testing.T) {
+	env := &ruleEnv{
+		auth: map[string]interface{}{"uid": "alice", "admin": true},
+		now:  1437139539000,
+		root: newNode(map[string]interface{}{
+			"users": map[string]interface{}{
+				"alice": map[string]interface{}{
+					"name":      "Alice",
+					"age":       30,
+					".priority": 2,
+				},
+			},
+			"flag": true,
+		}),
+		path: []string{"users", "alice"},
+		vars: map[string]string{"$uid": "alice"},
+	}
+
+	for _, test := range []struct {
+		src      string
+		expected interface{}
+	}{
+		// literals and operators
+		{"true", true},
+		{"null", nil},
+		{"'it\\'s'", "it's"},
+		{`"double"`, "double"},
+		{"1 + 2 * 3", 7.0},
+		{"(1 + 2) * 3", 9.0},
+		{"10 / 4 - 1", 1.5},
+		{"7 % 3", 1.0},
+		{"7.5 % 2", 1.5},
+		{"-7.5 % 2", -1.5},
+		{"1 % 0.5", 0.0},
+		{"2 % 0.75", 0.5},
+		{"-2 + 1", -1.0},
+		{"'a' + 1", "a1"},
+		{"1 < 2 && 2 <= 2 && 3 > 2 && 3 >= 4", false},
+		{"'a' < 'b'", true},
+		{"1 == 1.0", true},
+		{"1 === '1'", false},
+		{"null == null", true},
+		{"true != false", true},
+		{"!true || !false", true},
+		{"false && undefinedVar", false},
+		{"true || undefinedVar", true},
+		{"1 < 2 ? 'yes' : 'no'", "yes"},
+		{"[1, 'a']", []interface{}{1.0, "a"}},
+
+		// variables
+		{"auth.uid", "alice"},
+		{"auth['uid']", "alice"},
+		{"auth.missing", nil},
+		{"auth.uid === $uid", true},
+		{"now > 0", true},
+
+		// strings
+		{"auth.uid.length", 5.0},
+		{"auth.uid.contains('lic')", true},
+		{"auth.uid.beginsWith('al')", true},
+		{"auth.uid.endsWith('ce')", true},
+		{"auth.uid.replace('l', 'L')", "aLice"},
+		{"auth.uid.toUpperCase()", "ALICE"},
+		{"'ABC'.toLowerCase()", "abc"},
+		{"auth.uid.matches(/^a.*e$/)", true},
+		{"auth.uid.matches(/^A/i)", true},
+		{"auth.uid.matches(/^b/)", false},
+
+		// snapshots
+		{"data.child('name').val()", "Alice"},
+		{"data.child('age').isNumber()", true},
+		{"data.child('name').isString()", true},
+		{"root.child('flag').isBoolean()", true},
+		{"data.isString()", false},
+		{"data.exists()", true},
+		{"data.child('nope').exists()", false},
+		{"data.hasChild('name')", true},
+		{"data.hasChildren()", true},
+		{"data.hasChildren(['name', 'age'])", true},
+		{"data.hasChildren(['name', 'nope'])", false},
+		{"data.child('name').hasChildren()", false},
+		{"data.parent().parent().child('flag').val()", true},
+		{"root.child('users/alice/age').val() + 1", 31.0},
+		{"root.child('users').child(auth.uid).exists()", true},
+		{"data.getPriority()", json.Number("2")},
+		{"data.child('nope').getPriority()", nil},
+		{"root.parent()", nil},
+	} {
+		e, err := parseExpr(test.src)
+		require.NoError(t, err, test.src)
+
+		v, err := e.eval(env)
+		require.NoError(t, err, test.src)
+		assert.Equal(t, test.expected, v, test.src)
+	}
+}
+
+func TestExprEvalErrors(t *testing.T) {
+	env := &ruleEnv{root: newNode(nil)}
+
+	for _, src := range []string{
+		"auth.uid",
+		"newData.exists()",
+		"$uid",
+		"foo",
+		"1 && true",
+		"true && 1",
+		"!1",
+		"-'a'",
+		"'a' * 2",
+		"1 < 'a'",
+		"1 % 0",
+		"1 % 0.0",
+		"1 ? 2 : 3",
+		"data.nope()",
+		"data.child(1)",
+		"data.hasChildren('a')",
+		"'a'.matches('a')",
+		"'a'.nope",
+		"now()",
+		"now[1]",
+	} {
+		e, err := parseExpr(src)
+		require.NoError(t, err, src)
+
+		_, err = e.eval(env)
+		assert.Error(t, err, src)
+	}
+}
@@ -0,0 +1,299 @@
+package firetest
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+var (
+	errWriteTooLarge = errors.New("Data to write exceeds the maximum size that can be modified with a single request.")
+	errInvalidKey    = errors.New(`Invalid data; couldn't parse JSON object, array, or value. Perhaps you're using invalid characters in your key names.`)
+	errInvalidPath   = errors.New("Invalid path: Invalid token in path")
+	errInvalidUpdate = errors.New("Invalid data; couldn't parse JSON object. Are you sending a JSON object with valid key names?")
+)
+
+// Errors wrapped by a PathError
+var (
+	ErrEmptyKey           = errors.New("key cannot be empty")
+	ErrInvalidKey         = errors.New(`key cannot contain ".", "$", "#", "[", "]", "/" or ASCII control characters`)
+	ErrKeyTooLong         = errors.New("key is too long")
+	ErrTooDeep            = errors.New("path is too deep")
+	ErrStringTooLong      = errors.New("string is too long")
+	ErrInvalidServerValue = errors.New("unrecognized server value")
+	ErrInvalidValue       = errors.New(".value must be a string, number or boolean")
+	ErrInvalidUpdate      = errors.New("update data must be an object")
+	ErrInvalidPriority    = errors.New("priority must be a string, number or null")
+	ErrMixedValue         = errors.New(".value and .sv cannot be written along with other keys")
+	ErrOverlappingPaths   = errors.New("update paths cannot be the same as or an ancestor of another")
+)
+
+// PathError is returned when a location, or the data
+// written to it, cannot be used with Firebase
+type PathError struct {
+	// Path is the location that is not valid
+	Path string
+	// Key is the key of Path that is not valid, if any
+	Key string
+	// Err is one of ErrEmptyKey, ErrInvalidKey, ErrKeyTooLong,
+	// ErrTooDeep, ErrStringTooLong, ErrInvalidServerValue,
+	// ErrInvalidValue, ErrInvalidUpdate, ErrInvalidPriority,
+	// ErrMixedValue and ErrOverlappingPaths
+	Err error
+}
+
+func (e *PathError) Error() string {
+	if e.Key == "" {
+		return fmt.Sprintf("firetest: /%s: %v", e.Path, e.Err)
+	}
+	return fmt.Sprintf("firetest: /%s: invalid key %q: %v", e.Path, e.Key, e.Err)
+}
+
+// TypeError is returned when data of a Go type
+// that cannot be stored in Firebase is written
+type TypeError struct {
+	// Path is the location the data would be stored at
+	Path string
+	// Value is the data that cannot be stored
+	Value interface{}
+}
+
+func (e *TypeError) Error() string {
+	return fmt.Sprintf("firetest: /%s: unsupported type %T", e.Path, e.Value)
+}
+
+// Limits are the restrictions placed on the data written to a
+// Firetest server. Writes that break them are rejected with a
+// *PathError, which the REST API reports as a 400 Bad Request
+// just like Firebase does.
+//
+// Reference https://www.firebase.com/docs/web/guide/understanding-data.html#section-creating-references
+type Limits struct {
+	// MaxDepth is how many keys deep data can be stored
+	MaxDepth int
+	// MaxKeyLength is the maximum length of a key in bytes
+	MaxKeyLength int
+	// MaxStringSize is the maximum length of a string in bytes
+	MaxStringSize int
+	// MaxWriteSize is the maximum size of a request body in bytes
+	MaxWriteSize int64
+}
+
+// DefaultLimits are the limits of Firebase
+var DefaultLimits = Limits{
+	MaxDepth:      32,
+	MaxKeyLength:  768,
+	MaxStringSize: 10 << 20,
+	MaxWriteSize:  256 << 20,
+}
+
+// validKey reports whether k can be used as a key. Keys cannot
+// be empty nor contain . $ # [ ] / or ASCII control characters.
+func validKey(k string) bool {
+	if k == "" {
+		return false
+	}
+	for _, c := range k {
+		if c < 32 || c == 127 || strings.ContainsRune(".$#[]/", c) {
+			return false
+		}
+	}
+	return true
+}
+
+// keyError returns the reason why k is not a valid key, if it is not
+func (l Limits) keyError(k string) error {
+	switch {
+	case k == "":
+		return ErrEmptyKey
+	case !validKey(k):
+		return ErrInvalidKey
+	case len(k) > l.MaxKeyLength:
+		return ErrKeyTooLong
+	}
+	return nil
+}
+
+// checkPath returns a *PathError if path is not a valid location.
+// Its last key can be .priority to reference the priority of its parent.
+func (l Limits) checkPath(path string) error {
+	keys := splitPath(path)
+	if len(keys) > 0 && keys[len(keys)-1] == priorityKey {
+		keys = keys[:len(keys)-1]
+	}
+
+	if len(keys) > l.MaxDepth {
+		return &PathError{Path: path, Err: ErrTooDeep}
+	}
+	for _, k := range keys {
+		if err := l.keyError(k); err != nil {
+			return &PathError{Path: path, Key: k, Err: err}
+		}
+	}
+	return nil
+}
+
+// checkPriority returns a *PathError if v, written at the
+// .priority path, cannot be used as a priority
+func checkPriority(path string, v interface{}) error {
+	if v != nil && newPriority(v) == nil {
+		return &PathError{Path: path, Err: ErrInvalidPriority}
+	}
+	return nil
+}
+
+// checkMixedValue returns a *PathError if the object v has a .value
+// or .sv key along with any other key but .priority, since it would
+// then hold both a value and children
+func checkMixedValue(path string, v map[string]interface{}) error {
+	_, sv := v[serverValueKey]
+	_, value := v[valueKey]
+	if !sv && !value {
+		return nil
+	}
+
+	others := len(v)
+	if _, ok := v[priorityKey]; ok {
+		others--
+	}
+	if others > 1 {
+		return &PathError{Path: path, Err: ErrMixedValue}
+	}
+	return nil
+}
+
+// checkData returns a *PathError if v cannot be written at path, or
+// a *TypeError if it is not one of the types data decoded from JSON
+// can have. The data is checked as given, before newNode drops the
+// parts of it that Firebase ignores.
+func (l Limits) checkData(path string, v interface{}) error {
+	if len(splitPath(path)) > l.MaxDepth {
+		return &PathError{Path: path, Err: ErrTooDeep}
+	}
+
+	switch v := v.(type) {
+	case nil, bool:
+	case string:
+		if len(v) > l.MaxStringSize {
+			return &PathError{Path: path, Err: ErrStringTooLong}
+		}
+	case []interface{}:
+		for i, child := range v {
+			if err := l.checkData(joinPath(path, strconv.Itoa(i)), child); err != nil {
+				return err
+			}
+		}
+	case map[string]string:
+		m, _ := object(v)
+		return l.checkData(path, m)
+	case map[string]interface{}:
+		if err := checkMixedValue(path, v); err != nil {
+			return err
+		}
+		for k, child := range v {
+			childPath := joinPath(path, k)
+			switch k {
+			case serverValueKey:
+				if _, ok := newServerValue(child); !ok {
+					return &PathError{Path: path, Err: ErrInvalidServerValue}
+				}
+				continue
+			case priorityKey:
+				// invalid priorities are ignored
+				continue
+			case valueKey:
+				switch child.(type) {
+				case map[string]interface{}, map[string]string, []interface{}:
+					return &PathError{Path: path, Err: ErrInvalidValue}
+				}
+				childPath = path
+			default:
+				if err := l.keyError(k); err != nil {
+					return &PathError{Path: childPath, Key: k, Err: err}
+				}
+			}
+
+			if err := l.checkData(childPath, child); err != nil {
+				return err
+			}
+		}
+	default:
+		if _, ok := newNumber(v); !ok {
+			return &TypeError{Path: path, Value: v}
+		}
+	}
+	return nil
+}
+
+// checkUpdate is checkData for the data written by an
+// update, whose keys can span several levels
+func (l Limits) checkUpdate(path string, v interface{}) error {
+	children, ok := object(v)
+	if !ok {
+		return l.checkData(path, v)
+	}
+	if err := checkMixedValue(path, children); err != nil {
+		return err
+	}
+
+	for k, child := range children {
+		switch k {
+		case priorityKey, serverValueKey, valueKey:
+			if err := l.checkData(path, map[string]interface{}{k: child}); err != nil {
+				return err
+			}
+			continue
+		}
+
+		rel := strings.Trim(k, "/")
+		if rel == "" {
+			// the key would replace the location being updated
+			return &PathError{Path: path, Key: k, Err: ErrEmptyKey}
+		}
+
+		p := joinPath(path, rel)
+		for _, key := range splitPath(rel) {
+			if err := l.keyError(key); err != nil {
+				return &PathError{Path: p, Key: key, Err: err}
+			}
+		}
+		if err := l.checkData(p, child); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// restError returns the error reported over the REST API,
+// in the words of Firebase, for an error returned by a write
+func (l Limits) restError(err error) error {
+	e, ok := err.(*PathError)
+	if !ok {
+		return err
+	}
+
+	switch e.Err {
+	case ErrEmptyKey, ErrInvalidKey:
+		return errInvalidKey
+	case ErrKeyTooLong:
+		return fmt.Errorf("Invalid data; key longer than %d bytes", l.MaxKeyLength)
+	case ErrTooDeep:
+		return fmt.Errorf("Invalid data; path /%s exceeds the maximum depth of %d", e.Path, l.MaxDepth)
+	case ErrStringTooLong:
+		return fmt.Errorf("Invalid data; string at /%s longer than %d bytes", e.Path, l.MaxStringSize)
+	case ErrInvalidServerValue:
+		return fmt.Errorf("Invalid data; unrecognized server value at /%s", e.Path)
+	case ErrInvalidValue:
+		return fmt.Errorf("Invalid data; .value at /%s must be a primitive", e.Path)
+	case ErrInvalidUpdate:
+		return errInvalidUpdate
+	case ErrMixedValue:
+		return fmt.Errorf("Invalid data; found other keys along with .value or .sv at /%s", e.Path)
+	case ErrInvalidPriority:
+		return fmt.Errorf("Invalid data; priority at /%s must be a string, a number or null", e.Path)
+	case ErrOverlappingPaths:
+		return fmt.Errorf("Invalid data; path /%s overlaps another path in the same update", e.Path)
+	}
+	return err
+}
@@ -0,0 +1,213 @@
+package firetest
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidKey(t *testing.T) {
+	for _, test := range []struct {
+		key   string
+		valid bool
+	}{
+		{"foo", true},
+		{"foo bar", true},
+		{"-JuRBGFsA1b2", true},
+		{"ünicode", true},
+		{"", false},
+		{"a.b", false},
+		{"$x", false},
+		{"a#b", false},
+		{"a[0]", false},
+		{"a/b", false},
+		{"a\nb", false},
+		{"a\x7fb", false},
+	} {
+		assert.Equal(t, test.valid, validKey(test.key), "%q", test.key)
+	}
+}
+
+func TestLimitsCheckData(t *testing.T) {
+	l := Limits{MaxDepth: 3, MaxKeyLength: 5, MaxStringSize: 5}
+
+	for _, test := range []struct {
+		path  string
+		data  interface{}
+		valid bool
+	}{
+		{"", map[string]interface{}{"a": map[string]interface{}{"b": map[string]interface{}{"c": 1}}}, true},
+		{"a", map[string]interface{}{"b": map[string]interface{}{"c": 1}}, true},
+		{"a/b", map[string]interface{}{"c": map[string]interface{}{"d": 1}}, false},
+		{"a/b/c/d", nil, false},
+		{"", []interface{}{"abcde", "abcdef"}, false},
+		{"", map[string]interface{}{"abcde": 1}, true},
+		{"", map[string]interface{}{"abcdef": 1}, false},
+		{"", map[string]interface{}{"a.b": 1}, false},
+		{"", map[string]interface{}{"a": map[string]interface{}{"$b": 1}}, false},
+		{"", map[string]interface{}{".value": "abc", ".priority": 1}, true},
+		{"", map[string]interface{}{".value": map[string]interface{}{"a": 1}}, false},
+		{"", map[string]interface{}{".sv": "timestamp"}, true},
+		{"", map[string]interface{}{".sv": "bogus"}, false},
+		{"", "abcdef", false},
+	} {
+		err := l.checkData(test.path, test.data)
+		assert.Equal(t, test.valid, err == nil, "%s %v: %v", test.path, test.data, err)
+	}
+}
+
+func TestLimitsCheckUpdate(t *testing.T) {
+	l := Limits{MaxDepth: 3, MaxKeyLength: 5, MaxStringSize: 5}
+
+	for _, test := range []struct {
+		path  string
+		data  interface{}
+		valid bool
+	}{
+		{"", map[string]interface{}{"a/b/c": 1, "d": "abc"}, true},
+		{"", map[string]interface{}{"/a/b/": 1}, true},
+		{"", map[string]string{"a/b/c": "x", "/d/": "y"}, true},
+		{"", map[string]string{"a/b#": "x"}, false},
+		{"a", map[string]interface{}{"": 1}, false},
+		{"", map[string]interface{}{"/": 1}, false},
+		{"a", map[string]interface{}{"//": 1}, false},
+		{"", map[string]interface{}{"a/b/c/d": 1}, false},
+		{"a", map[string]interface{}{"b/c": map[string]interface{}{"d": 1}}, false},
+		{"", map[string]interface{}{"a/b.c": 1}, false},
+		{"", map[string]interface{}{"a/abcdef": 1}, false},
+		{"", map[string]interface{}{".priority": 1}, true},
+		{"", map[string]interface{}{".sv": "bogus"}, false},
+		{"", "abc", true},
+	} {
+		err := l.checkUpdate(test.path, test.data)
+		assert.Equal(t, test.valid, err == nil, "%s %v: %v", test.path, test.data, err)
+	}
+}
+
+func TestLimitsRESTError(t *testing.T) {
+	l := DefaultLimits
+	assert.Equal(t, errInvalidKey, l.restError(l.checkData("", map[string]interface{}{"a.b": 1})))
+	assert.Equal(t, errInvalidKey, l.restError(l.checkUpdate("", map[string]interface{}{"a//b": 1})))
+
+	err := l.restError(l.checkData("", map[string]interface{}{strings.Repeat("a", 769): 1}))
+	assert.EqualError(t, err, "Invalid data; key longer than 768 bytes")
+
+	err = l.restError(l.checkData(strings.Repeat("a/", 32)+"a", 1))
+	assert.EqualError(t, err, "Invalid data; path /"+strings.Repeat("a/", 32)+"a exceeds the maximum depth of 32")
+
+	err = l.restError(l.checkData("a", map[string]interface{}{"b": map[string]interface{}{".sv": "now"}}))
+	assert.EqualError(t, err, "Invalid data; unrecognized server value at /a/b")
+
+	err = l.restError(l.checkData("a", map[string]interface{}{".value": []interface{}{1}}))
+	assert.EqualError(t, err, "Invalid data; .value at /a must be a primitive")
+
+	_, err = newUpdate("a", map[string]interface{}{"b": 1, "b/c": 2})
+	assert.EqualError(t, l.restError(err), "Invalid data; path /a/b/c overlaps another path in the same update")
+
+	l.MaxStringSize = 1
+	err = l.restError(l.checkData("a", "ab"))
+	assert.EqualError(t, err, "Invalid data; string at /a longer than 1 bytes")
+
+	assert.Equal(t, errInvalidPath, l.restError(errInvalidPath))
+}
+
+func TestLimitsCheckPath(t *testing.T) {
+	l := Limits{MaxDepth: 3, MaxKeyLength: 6}
+
+	for _, test := range []struct {
+		path string
+		key  string
+		err  error
+	}{
+		{"", "", nil},
+		{"a/b/c", "", nil},
+		{"a/b/c/.priority", "", nil},
+		{"ünï/cödé", "", nil},
+		{"a/b/c/d", "", ErrTooDeep},
+		{"a//b", "", ErrEmptyKey},
+		{"a/b.c", "b.c", ErrInvalidKey},
+		{"$a", "$a", ErrInvalidKey},
+		{".priority/a", ".priority", ErrInvalidKey},
+		{"a/abcdefg", "abcdefg", ErrKeyTooLong},
+	} {
+		err := l.checkPath(test.path)
+		if test.err == nil {
+			assert.NoError(t, err, test.path)
+			continue
+		}
+		if assert.IsType(t, &PathError{}, err, test.path) {
+			pe := err.(*PathError)
+			assert.Equal(t, test.path, pe.Path)
+			assert.Equal(t, test.key, pe.Key, test.path)
+			assert.Equal(t, test.err, pe.Err, test.path)
+		}
+	}
+}
+
+func TestLimitsPathErrors(t *testing.T) {
+	l := Limits{MaxDepth: 3, MaxKeyLength: 5, MaxStringSize: 5}
+
+	assert.NoError(t, l.checkData("a", map[string]interface{}{"b": map[string]interface{}{"c": 1}}))
+	assert.Equal(t, &PathError{Path: "a/b/c/d", Err: ErrTooDeep},
+		l.checkData("a", map[string]interface{}{"b": map[string]interface{}{"c": map[string]interface{}{"d": 1}}}))
+	assert.Equal(t, &PathError{Path: "a/b/c#", Key: "c#", Err: ErrInvalidKey},
+		l.checkData("a", map[string]interface{}{"b": map[string]string{"c#": "x"}}))
+	assert.Equal(t, &PathError{Path: "a/b/abcdef", Key: "abcdef", Err: ErrKeyTooLong},
+		l.checkData("a", map[string]interface{}{"b": map[string]interface{}{"abcdef": 1}}))
+	assert.Equal(t, &PathError{Path: "a/b", Err: ErrStringTooLong},
+		l.checkData("a", map[string]interface{}{"b": "abcdef"}))
+	assert.Equal(t, &PathError{Path: "a/b", Err: ErrInvalidServerValue},
+		l.checkData("a", map[string]interface{}{"b": map[string]interface{}{".sv": "now"}}))
+	assert.Equal(t, &PathError{Path: "a", Err: ErrInvalidValue},
+		l.checkData("a", map[string]interface{}{".value": map[string]interface{}{"b": 1}}))
+	assert.Equal(t, &PathError{Path: "a", Err: ErrMixedValue},
+		l.checkData("a", map[string]interface{}{".sv": "timestamp", "b": 1}))
+	assert.Equal(t, &PathError{Path: "a/b", Err: ErrMixedValue},
+		l.checkData("a", map[string]interface{}{"b": map[string]interface{}{".value": 1, "c": 1}}))
+	assert.Equal(t, &PathError{Path: "a", Err: ErrMixedValue},
+		l.checkData("a", map[string]interface{}{".value": 1, ".sv": "timestamp"}))
+	assert.NoError(t, l.checkData("a", map[string]interface{}{".value": 1, ".priority": 1}))
+	assert.NoError(t, l.checkData("a", map[string]interface{}{".sv": "timestamp", ".priority": 1}))
+
+	assert.NoError(t, l.checkUpdate("a", map[string]interface{}{"b/c": 1}))
+	assert.Equal(t, &PathError{Path: "a/b/c.d", Key: "c.d", Err: ErrInvalidKey},
+		l.checkUpdate("a", map[string]interface{}{"b/c.d": 1}))
+	assert.Equal(t, &PathError{Path: "a/b/.priority", Key: ".priority", Err: ErrInvalidKey},
+		l.checkUpdate("a", map[string]interface{}{"b/.priority": 1}))
+	assert.Equal(t, &PathError{Path: "a", Key: "/", Err: ErrEmptyKey},
+		l.checkUpdate("a", map[string]interface{}{"/": 1}))
+	assert.Equal(t, &PathError{Path: "a", Err: ErrMixedValue},
+		l.checkUpdate("a", map[string]interface{}{".sv": "timestamp", "b/c": 1}))
+}
+
+func TestPathError(t *testing.T) {
+	err := &PathError{Path: "a/b.c", Key: "b.c", Err: ErrInvalidKey}
+	assert.Equal(t, `firetest: /a/b.c: invalid key "b.c": `+ErrInvalidKey.Error(), err.Error())
+
+	err = &PathError{Path: "a/b", Err: ErrTooDeep}
+	assert.Equal(t, "firetest: /a/b: path is too deep", err.Error())
+
+	err = &PathError{Path: "a/b", Err: ErrStringTooLong}
+	assert.Equal(t, "firetest: /a/b: string is too long", err.Error())
+}
+
+func TestLimitsCheckDataTypes(t *testing.T) {
+	for _, test := range []struct {
+		data interface{}
+		err  error
+	}{
+		{map[string]interface{}{"a": []interface{}{"b", 1, 2.5, true, nil}, "c": map[string]string{"d": "e"}}, nil},
+		{map[string]interface{}{".priority": struct{}{}, "a": 1}, nil},
+		{struct{}{}, &TypeError{Path: "x", Value: struct{}{}}},
+		{[]string{"a"}, &TypeError{Path: "x", Value: []string{"a"}}},
+		{map[string]int{"a": 1}, &TypeError{Path: "x", Value: map[string]int{"a": 1}}},
+		{map[string]interface{}{"a": []interface{}{1, complex(1, 2)}}, &TypeError{Path: "x/a/1", Value: complex(1, 2)}},
+		{map[string]interface{}{".value": []byte("a")}, &TypeError{Path: "x", Value: []byte("a")}},
+	} {
+		assert.Equal(t, test.err, DefaultLimits.checkData("x", test.data), "%v", test.data)
+	}
+
+	err := &TypeError{Path: "a/b", Value: struct{}{}}
+	assert.Equal(t, "firetest: /a/b: unsupported type struct {}", err.Error())
+}
@@ -1,56 +1,223 @@
 package firetest
 
 import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
+	"sort"
 	"strconv"
+	"strings"
+)
+
+// Pseudo-keys used to read and write the priority
+// of a node alongside its value
+const (
+	priorityKey = ".priority"
+	valueKey    = ".value"
 )
 
 type node struct {
-	value     interface{}
-	children  map[string]*node
-	parent    *node
-	sliceKids bool
+	value    interface{}
+	priority interface{}
+	children map[string]*node
+	parent   *node
 }
 
+// newNode builds the node holding data, which must have been
+// accepted by Limits.checkData or Limits.checkUpdate, or
+// newNode panics on types that cannot be stored
 func newNode(data interface{}) *node {
 	n := &node{children: map[string]*node{}}
 
 	switch data := data.(type) {
 	case map[string]interface{}:
+		if sv, ok := newServerValue(data[serverValueKey]); ok {
+			n.value = sv
+			break
+		}
 		for k, v := range data {
-			child := newNode(v)
-			child.parent = n
-			n.children[k] = child
+			n.setKey(k, v)
 		}
 	case map[string]string:
+		if sv, ok := newServerValue(data[serverValueKey]); ok {
+			n.value = sv
+			break
+		}
 		for k, v := range data {
-			child := newNode(v)
-			child.parent = n
-			n.children[k] = child
+			n.setKey(k, v)
 		}
 	case []interface{}:
-		n.sliceKids = true
 		for i, v := range data {
-			child := newNode(v)
-			child.parent = n
-			n.children[fmt.Sprint(i)] = child
+			n.setKey(fmt.Sprint(i), v)
 		}
-	case string, int, int8, int16, int32, int64, float32, float64, bool:
+	case string, bool:
 		n.value = data
 	case nil:
 		// do nothing
 	default:
-		panic(fmt.Sprintf("Type(%T) not supported\n", data))
+		number, ok := newNumber(data)
+		if !ok {
+			panic(fmt.Sprintf("Type(%T) not supported\n", data))
+		}
+		n.value = number
 	}
 
 	return n
 }
 
+// object returns v as a map[string]interface{}
+// if it is one of the objects newNode accepts
+func object(v interface{}) (map[string]interface{}, bool) {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		return v, true
+	case map[string]string:
+		m := make(map[string]interface{}, len(v))
+		for k, child := range v {
+			m[k] = child
+		}
+		return m, true
+	}
+	return nil, false
+}
+
+// setKey stores v under the key k, handling the
+// .priority and .value pseudo-keys. Just like in Firebase,
+// children without data, such as null or {}, are not stored.
+func (n *node) setKey(k string, v interface{}) {
+	switch k {
+	case priorityKey:
+		n.priority = newPriority(v)
+	case valueKey:
+		n.value = newNode(v).value
+	default:
+		child := newNode(v)
+		if child.isNil() {
+			return
+		}
+		child.parent = n
+		n.children[k] = child
+	}
+}
+
+// newUpdate returns the node holding the children written by an update
+// of path with v. Its keys can be paths to deeper locations, so that
+// several of them are written at once, as long as none is the same as
+// or an ancestor of another, which is an ErrOverlappingPaths.
+//
+// Reference https://www.firebase.com/blog/2015-09-24-atomic-writes-and-more.html
+func newUpdate(path string, v interface{}) (*node, error) {
+	n := newNode(v)
+	if m, ok := object(v); ok && n.value == nil {
+		// keep the children without data, which the update removes
+		for k, child := range m {
+			if _, ok := n.children[k]; !ok && k != priorityKey && k != valueKey {
+				n.children[k] = newNode(child)
+			}
+		}
+	}
+
+	children := make(map[string]*node, len(n.children))
+	for k, child := range n.children {
+		p := strings.Trim(k, "/")
+		if _, ok := children[p]; ok {
+			return nil, &PathError{Path: joinPath(path, p), Err: ErrOverlappingPaths}
+		}
+		children[p] = child
+	}
+	n.children = children
+
+	for p := range children {
+		for parent := p; parent != ""; {
+			i := strings.LastIndex(parent, "/")
+			if i < 0 {
+				parent = ""
+			} else {
+				parent = parent[:i]
+			}
+			if _, ok := children[parent]; ok {
+				return nil, &PathError{Path: joinPath(path, p), Err: ErrOverlappingPaths}
+			}
+		}
+	}
+	return n, nil
+}
+
+// newPriority returns v if it is a valid priority, which
+// can only be a string or a number, and nil otherwise.
+func newPriority(v interface{}) interface{} {
+	if s, ok := v.(string); ok {
+		return s
+	}
+	if number, ok := newNumber(v); ok {
+		return number
+	}
+	return nil
+}
+
 func (n *node) MarshalJSON() ([]byte, error) {
-	return json.Marshal(n.objectify())
+	return json.Marshal(ordered(n.objectify()))
+}
+
+// orderedObject is a JSON object whose keys are
+// marshaled in the order Firebase returns them
+type orderedObject map[string]interface{}
+
+func (o orderedObject) MarshalJSON() ([]byte, error) {
+	keys := make([]string, 0, len(o))
+	for k := range o {
+		keys = append(keys, k)
+	}
+	sort.Sort(byKey(keys))
+
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	for i, k := range keys {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		key, _ := json.Marshal(k)
+		buf.Write(key)
+		buf.WriteByte(':')
+
+		value, err := json.Marshal(o[k])
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(value)
+	}
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
+
+// ordered returns v, as returned by objectify, with
+// its objects replaced by orderedObjects
+func ordered(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		o := make(orderedObject, len(v))
+		for k, child := range v {
+			o[k] = ordered(child)
+		}
+		return o
+	case []interface{}:
+		a := make([]interface{}, len(v))
+		for i, child := range v {
+			a[i] = ordered(child)
+		}
+		return a
+	}
+	return v
 }
 
+type byKey []string
+
+func (b byKey) Len() int           { return len(b) }
+func (b byKey) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
+func (b byKey) Less(i, j int) bool { return compareKeys(b[i], b[j]) < 0 }
+
 func (n *node) objectify() interface{} {
 	if n.isNil() {
 		return nil
@@ -60,13 +227,10 @@ func (n *node) objectify() interface{} {
 		return n.value
 	}
 
-	if n.sliceKids {
-		obj := make([]interface{}, len(n.children))
+	if size, ok := n.arrayLen(); ok {
+		obj := make([]interface{}, size)
 		for k, v := range n.children {
-			index, err := strconv.Atoi(k)
-			if err != nil {
-				continue
-			}
+			index, _ := arrayIndex(k)
 			obj[index] = v.objectify()
 		}
 		return obj
@@ -80,15 +244,170 @@ func (n *node) objectify() interface{} {
 	return obj
 }
 
-func (n *node) isNil() bool {
-	return n.value == nil && len(n.children) == 0
+// arrayLen returns the length of the array n is read as. Just like in
+// Firebase, a node is read as an array if all of its keys are integers
+// and the largest is less than twice the number of keys, so keys 0 and
+// 3 are an array while 0 and 4 are not. The missing indexes are read
+// as null.
+//
+// Reference https://www.firebase.com/docs/web/guide/understanding-data.html#section-arrays-in-firebase
+func (n *node) arrayLen() (int, bool) {
+	if len(n.children) == 0 {
+		return 0, false
+	}
+
+	max := 0
+	for k := range n.children {
+		index, ok := arrayIndex(k)
+		if !ok {
+			return 0, false
+		}
+		if index > max {
+			max = index
+		}
+	}
+
+	if max >= 2*len(n.children) {
+		return 0, false
+	}
+	return max + 1, true
 }
 
-func (n *node) merge(newNode *node) {
-	for k, v := range newNode.children {
-		n.children[k] = v
+// arrayIndex returns the index k stands for if it is
+// a non-negative integer without leading zeros
+func arrayIndex(k string) (int, bool) {
+	if k == "" || len(k) > 9 || k[0] == '0' && k != "0" {
+		return 0, false
 	}
-	n.value = newNode.value
+	for _, c := range k {
+		if c < '0' || c > '9' {
+			return 0, false
+		}
+	}
+
+	index, err := strconv.Atoi(k)
+	return index, err == nil
+}
+
+// child returns the descendant of n found at the given
+// slash separated path or nil if it does not exist.
+func (n *node) child(path string) *node {
+	if n == nil {
+		return nil
+	}
+
+	current := n
+	for _, step := range strings.Split(path, "/") {
+		if step == "" {
+			continue
+		}
+
+		var ok bool
+		current, ok = current.children[step]
+		if !ok {
+			return nil
+		}
+	}
+	return current
+}
+
+// export returns the value of n including the priorities
+// of it and all of its children.
+//
+// Reference https://www.firebase.com/docs/rest/api/#section-param-format
+func (n *node) export() interface{} {
+	if n.isNil() {
+		return nil
+	}
+
+	if n.value != nil {
+		if n.priority == nil {
+			return n.value
+		}
+		return map[string]interface{}{
+			valueKey:    n.value,
+			priorityKey: n.priority,
+		}
+	}
+
+	obj := map[string]interface{}{}
+	for k, v := range n.children {
+		obj[k] = v.export()
+	}
+	if n.priority != nil {
+		obj[priorityKey] = n.priority
+	}
+	return obj
+}
+
+// shallow returns the value of n truncated to a single level:
+// children that are objects are replaced with true.
+func (n *node) shallow() interface{} {
+	if n.isNil() || len(n.children) == 0 {
+		return n.objectify()
+	}
+
+	obj := map[string]interface{}{}
+	for k, v := range n.children {
+		if len(v.children) > 0 {
+			obj[k] = true
+			continue
+		}
+		obj[k] = v.objectify()
+	}
+	return obj
+}
+
+// copy returns a shallow copy of n that shares its children.
+// A nil node is copied as an empty one.
+func (n *node) copy() *node {
+	cp := &node{children: map[string]*node{}}
+	if n == nil {
+		return cp
+	}
+
+	cp.value, cp.priority = n.value, n.priority
+	for k, v := range n.children {
+		cp.children[k] = v
+	}
+	return cp
+}
+
+// clone returns a deep copy of n. Unlike copy,
+// a nil node is cloned as nil.
+func (n *node) clone() *node {
+	if n == nil {
+		return nil
+	}
+
+	cp := n.copy()
+	for k, v := range n.children {
+		child := v.clone()
+		child.parent = cp
+		cp.children[k] = child
+	}
+	return cp
+}
+
+// nullETag is the ETag of a location without data
+const nullETag = "null_etag"
+
+// etag returns the ETag identifying the contents of n,
+// including its priorities.
+//
+// Reference https://www.firebase.com/docs/rest/api/#section-conditional-requests
+func (n *node) etag() string {
+	if n.isNil() {
+		return nullETag
+	}
+
+	b, _ := json.Marshal(n.export())
+	sum := sha1.Sum(b)
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+func (n *node) isNil() bool {
+	return n == nil || n.value == nil && len(n.children) == 0
 }
 
 func (n *node) prune() *node {
@@ -19,11 +19,37 @@ func newTestNodeWithKids(children map[string]*node) *node {
 	return n
 }
 
+// jsonNumbers replaces the Go numbers in v with the
+// json.Number they are stored as
+func jsonNumbers(v interface{}) interface{} {
+	switch v := v.(type) {
+	case int, int64, float64:
+		return json.Number(fmt.Sprint(v))
+	case []interface{}:
+		arr := make([]interface{}, len(v))
+		for i, child := range v {
+			arr[i] = jsonNumbers(child)
+		}
+		return arr
+	case map[string]interface{}:
+		obj := make(map[string]interface{}, len(v))
+		for k, child := range v {
+			obj[k] = jsonNumbers(child)
+		}
+		return obj
+	}
+	return v
+}
+
 func equalNodes(expected, actual *node) error {
 	if ec, ac := len(expected.children), len(actual.children); ec != ac {
 		return fmt.Errorf("Children count is not the same\n\tExpected: %d\n\tActual: %d", ec, ac)
 	}
 
+	if !assert.ObjectsAreEqualValues(expected.priority, actual.priority) {
+		return fmt.Errorf("Node priorities not equal\n\tExpected: %v\n\tActual: %v", expected.priority, actual.priority)
+	}
+
 	if len(expected.children) == 0 {
 		if !assert.ObjectsAreEqualValues(expected.value, actual.value) {
 			return fmt.Errorf("Node values not equal\n\tExpected: %T %v\n\tActual: %T %v", expected.value, expected.value, actual.value, actual.value)
@@ -189,8 +215,111 @@ func TestObjectify(t *testing.T) {
 		},
 	} {
 		node := newNode(test.object)
-		assert.Equal(t, test.object, node.objectify())
+		assert.Equal(t, jsonNumbers(test.object), node.objectify())
+	}
+}
+
+func TestNewNodeNulls(t *testing.T) {
+	for _, test := range []struct {
+		data     interface{}
+		expected interface{}
+	}{
+		{nil, nil},
+		{map[string]interface{}{}, nil},
+		{map[string]interface{}{"a": nil}, nil},
+		{map[string]interface{}{"a": map[string]interface{}{"b": nil, "c": map[string]interface{}{}}}, nil},
+		{map[string]interface{}{"a": nil, "b": 1}, map[string]interface{}{"b": json.Number("1")}},
+		{[]interface{}{}, nil},
+		{[]interface{}{"a", nil, "c"}, []interface{}{"a", nil, "c"}},
+	} {
+		n := newNode(test.data)
+		assert.Equal(t, test.expected, n.objectify(), "%v", test.data)
+		assert.Equal(t, test.expected == nil, n.isNil(), "%v", test.data)
+	}
+
+	n := newNode([]interface{}{"a", nil, "c"})
+	assert.Len(t, n.children, 2)
+}
+
+func TestObjectifyArrays(t *testing.T) {
+	for _, test := range []struct {
+		data     map[string]interface{}
+		expected interface{}
+	}{
+		{
+			data:     map[string]interface{}{"0": "a", "1": "b", "2": "c"},
+			expected: []interface{}{"a", "b", "c"},
+		},
+		{
+			data:     map[string]interface{}{"0": "a", "2": "c"},
+			expected: []interface{}{"a", nil, "c"},
+		},
+		{
+			data:     map[string]interface{}{"1": "b"},
+			expected: []interface{}{nil, "b"},
+		},
+		{
+			data:     map[string]interface{}{"2": "c", "3": "d"},
+			expected: []interface{}{nil, nil, "c", "d"},
+		},
+		{
+			data:     map[string]interface{}{"2": "c"},
+			expected: map[string]interface{}{"2": "c"},
+		},
+		{
+			data:     map[string]interface{}{"0": "a", "3": "d"},
+			expected: []interface{}{"a", nil, nil, "d"},
+		},
+		{
+			data:     map[string]interface{}{"0": "a", "4": "e"},
+			expected: map[string]interface{}{"0": "a", "4": "e"},
+		},
+		{
+			data:     map[string]interface{}{"0": "a", "1": "b", "x": "c"},
+			expected: map[string]interface{}{"0": "a", "1": "b", "x": "c"},
+		},
+		{
+			data:     map[string]interface{}{"0": "a", "01": "b"},
+			expected: map[string]interface{}{"0": "a", "01": "b"},
+		},
+		{
+			data:     map[string]interface{}{"0": "a", "-1": "b"},
+			expected: map[string]interface{}{"0": "a", "-1": "b"},
+		},
+		{
+			data:     map[string]interface{}{"0": map[string]interface{}{"0": true, "1": false}},
+			expected: []interface{}{[]interface{}{true, false}},
+		},
+	} {
+		assert.Equal(t, test.expected, newNode(test.data).objectify(), "%v", test.data)
 	}
+
+	n := newNode([]interface{}{"a", "b", "c"})
+	delete(n.children, "1")
+	assert.Equal(t, []interface{}{"a", nil, "c"}, n.objectify())
+	delete(n.children, "0")
+	assert.Equal(t, map[string]interface{}{"2": "c"}, n.objectify())
+}
+
+func TestMarshalJSONOrder(t *testing.T) {
+	n := newNode(map[string]interface{}{
+		"b":   1,
+		"a":   map[string]interface{}{"z": true, "10": 1, "9": 2, "y": []interface{}{map[string]interface{}{"d": 1, "c": 2}}},
+		"10":  "ten",
+		"2":   "two",
+		"-1":  "minus one",
+		"02":  "not an integer",
+		"A":   "upper",
+		"a b": "space",
+	})
+
+	b, err := json.Marshal(n)
+	require.NoError(t, err)
+	assert.Equal(t, `{"-1":"minus one","2":"two","10":"ten","02":"not an integer","A":"upper","a":{"9":2,"10":1,"y":[{"c":2,"d":1}],"z":true},"a b":"space","b":1}`, string(b))
+
+	b, err = json.Marshal((*node)(nil))
+	require.NoError(t, err)
+	assert.Equal(t, "null", string(b))
 }
 
 func TestPrune(t *testing.T) {
@@ -254,3 +383,155 @@ func TestPrune(t *testing.T) {
 	n.parent = newNode("hello!")
 	assert.Nil(t, n.prune())
 }
+
+func TestShallow(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		object   interface{}
+		expected interface{}
+	}{
+		{
+			name: "nil",
+		},
+		{
+			name:     "scalar",
+			object:   "foo",
+			expected: "foo",
+		},
+		{
+			name: "object",
+			object: map[string]interface{}{
+				"one_fish":     "two_fish",
+				"red_fish":     2.2,
+				"netflix_list": []interface{}{"Orange is the New Black", "House of Cards"},
+				"shopping_list": map[string]interface{}{
+					"publix": "milk",
+				},
+			},
+			expected: map[string]interface{}{
+				"one_fish":      "two_fish",
+				"red_fish":      json.Number("2.2"),
+				"netflix_list":  true,
+				"shopping_list": true,
+			},
+		},
+	} {
+		node := newNode(test.object)
+		assert.Equal(t, test.expected, node.shallow(), test.name)
+	}
+}
+
+func TestNewNodePriority(t *testing.T) {
+	n := newNode(map[string]interface{}{
+		".priority": 1.0,
+		"foo": map[string]interface{}{
+			".value":    "bar",
+			".priority": "b",
+		},
+		"bar": map[string]interface{}{
+			".priority": true,
+			"baz":       false,
+		},
+	})
+
+	assert.Equal(t, json.Number("1"), n.priority)
+	require.Len(t, n.children, 2)
+
+	foo := n.children["foo"]
+	assert.Equal(t, "bar", foo.value)
+	assert.Equal(t, "b", foo.priority)
+	assert.Empty(t, foo.children)
+
+	bar := n.children["bar"]
+	assert.Nil(t, bar.priority, "booleans are not valid priorities")
+	assert.Len(t, bar.children, 1)
+}
+
+func TestExport(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		object   interface{}
+		expected interface{}
+	}{
+		{
+			name: "nil",
+		},
+		{
+			name:     "scalar",
+			object:   "foo",
+			expected: "foo",
+		},
+		{
+			name:     "scalar with priority",
+			object:   map[string]interface{}{".value": "foo", ".priority": 1},
+			expected: map[string]interface{}{".value": "foo", ".priority": json.Number("1")},
+		},
+		{
+			name: "object with priorities",
+			object: map[string]interface{}{
+				".priority": "a",
+				"one_fish":  map[string]interface{}{".value": "two_fish", ".priority": 2},
+				"red_fish":  2.2,
+			},
+			expected: map[string]interface{}{
+				".priority": "a",
+				"one_fish":  map[string]interface{}{".value": "two_fish", ".priority": json.Number("2")},
+				"red_fish":  json.Number("2.2"),
+			},
+		},
+	} {
+		node := newNode(test.object)
+		assert.Equal(t, test.expected, node.export(), test.name)
+	}
+}
+
+func TestClone(t *testing.T) {
+	assert.Nil(t, (*node)(nil).clone())
+
+	n := newNode(map[string]interface{}{
+		"foo":       map[string]interface{}{"bar": 1},
+		".priority": 2,
+	})
+	cp := n.clone()
+	assert.NoError(t, equalNodes(n, cp))
+	assert.Equal(t, cp, cp.children["foo"].parent)
+
+	n.children["foo"].children["bar"].value = json.Number("3")
+	assert.Equal(t, json.Number("1"), cp.child("foo/bar").value, "clone should not share children")
+}
+
+func TestNewUpdate(t *testing.T) {
+	n, err := newUpdate("", map[string]interface{}{
+		"/a/b/": 1,
+		"a/c":   2,
+		"ab":    3,
+	})
+	require.NoError(t, err)
+	assert.Equal(t, jsonNumbers(map[string]interface{}{"a/b": 1, "a/c": 2, "ab": 3}), n.objectify())
+
+	for _, test := range []struct {
+		v    map[string]interface{}
+		path string
+	}{
+		{v: map[string]interface{}{"a": 1, "a/b": 2}, path: "x/a/b"},
+		{v: map[string]interface{}{"a/b": 1, "a/b/c/d": 2}, path: "x/a/b/c/d"},
+		{v: map[string]interface{}{"a/b": 1, "/a/b/": 2}, path: "x/a/b"},
+		{v: map[string]interface{}{"": 1, "a": 2}, path: "x/a"},
+	} {
+		_, err := newUpdate("x", test.v)
+		if assert.IsType(t, &PathError{}, err, "%v", test.v) {
+			assert.Equal(t, ErrOverlappingPaths, err.(*PathError).Err, "%v", test.v)
+			assert.Equal(t, test.path, err.(*PathError).Path, "%v", test.v)
+		}
+	}
+}
+
+func TestETag(t *testing.T) {
+	assert.Equal(t, nullETag, (*node)(nil).etag())
+	assert.Equal(t, nullETag, newNode(nil).etag())
+	assert.Equal(t, "n4nHQM60bXQYySSnisV5QdXpZSA=", newNode(map[string]interface{}{"a": 1}).etag())
+	assert.Equal(t, "vbLY58qhiO1csbApX2XOXiQrQyQ=", newNode("bar").etag())
+
+	withPriority := newNode(map[string]interface{}{"a": 1, ".priority": 1})
+	assert.NotEqual(t, newNode(map[string]interface{}{"a": 1}).etag(), withPriority.etag())
+}
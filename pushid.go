@@ -0,0 +1,80 @@
+package firetest
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// pushChars are the characters used in push IDs, in ascending
+// ASCII order so that IDs sort lexicographically
+const pushChars = "-0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZ_abcdefghijklmnopqrstuvwxyz"
+
+// pushIDGenerator generates the 20 character names Firebase uses for
+// children created with a POST. The first 8 characters encode the
+// timestamp in milliseconds and the remaining 12 are random. IDs
+// generated within the same millisecond increment the random part
+// of the previous ID so they remain unique and sorted.
+//
+// Reference https://www.firebase.com/blog/2015-02-11-firebase-unique-identifiers.html
+type pushIDGenerator struct {
+	mtx      sync.Mutex
+	rand     *rand.Rand
+	lastTime int64
+	lastRand [12]int
+}
+
+func newPushIDGenerator(seed int64) *pushIDGenerator {
+	g := &pushIDGenerator{}
+	g.seed(seed)
+	return g
+}
+
+// seed resets the generator so that the sequence of
+// IDs it generates is determined by the seed
+func (g *pushIDGenerator) seed(seed int64) {
+	g.mtx.Lock()
+	g.rand = rand.New(rand.NewSource(seed))
+	g.lastTime = -1
+	g.lastRand = [12]int{}
+	g.mtx.Unlock()
+}
+
+// next returns a new push ID for the given time. Times
+// before 1970 are encoded as 1970, which is the earliest
+// time a push ID can hold.
+func (g *pushIDGenerator) next(now time.Time) string {
+	g.mtx.Lock()
+	defer g.mtx.Unlock()
+
+	ts := millis(now)
+	if ts < 0 {
+		ts = 0
+	}
+	if ts == g.lastTime {
+		// increment the random part, carrying over
+		// into the previous character on overflow
+		for i := len(g.lastRand) - 1; i >= 0; i-- {
+			g.lastRand[i]++
+			if g.lastRand[i] < len(pushChars) {
+				break
+			}
+			g.lastRand[i] = 0
+		}
+	} else {
+		for i := range g.lastRand {
+			g.lastRand[i] = g.rand.Intn(len(pushChars))
+		}
+	}
+	g.lastTime = ts
+
+	var id [20]byte
+	for i := 7; i >= 0; i-- {
+		id[i] = pushChars[ts%int64(len(pushChars))]
+		ts /= int64(len(pushChars))
+	}
+	for i, r := range g.lastRand {
+		id[8+i] = pushChars[r]
+	}
+	return string(id[:])
+}
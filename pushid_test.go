@@ -0,0 +1,79 @@
+package firetest
+
+import (
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPushIDTimestamp(t *testing.T) {
+	g := newPushIDGenerator(1)
+
+	id := g.next(time.Unix(0, 0))
+	assert.Len(t, id, 20)
+	assert.Equal(t, "--------", id[:8])
+
+	id = g.next(time.Unix(0, int64(time.Millisecond)))
+	assert.Equal(t, "-------0", id[:8])
+
+	id = g.next(time.Time{})
+	assert.Equal(t, "--------", id[:8], "times before 1970 should be clamped")
+}
+
+func TestPushIDSameMillisecond(t *testing.T) {
+	g := newPushIDGenerator(1)
+	now := time.Unix(1437139539, 0)
+
+	g.lastTime = millis(now)
+	for i := range g.lastRand {
+		g.lastRand[i] = len(pushChars) - 1
+	}
+	g.lastRand[0] = 0
+
+	id := g.next(now)
+	assert.Equal(t, "0-----------", id[8:], "random part should carry over")
+
+	next := g.next(now)
+	assert.Equal(t, "0----------0", next[8:])
+	assert.True(t, id < next)
+}
+
+func TestPushIDSorted(t *testing.T) {
+	g := newPushIDGenerator(time.Now().UnixNano())
+	start := time.Now()
+
+	var ids []string
+	for i := 0; i < 1000; i++ {
+		ids = append(ids, g.next(start.Add(time.Duration(i/10)*time.Millisecond)))
+	}
+	assert.True(t, sort.StringsAreSorted(ids))
+}
+
+func TestPushIDConcurrent(t *testing.T) {
+	var (
+		g   = newPushIDGenerator(1)
+		now = time.Now()
+		ids = make(chan string, 100)
+		wg  sync.WaitGroup
+	)
+
+	for i := 0; i < cap(ids); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ids <- g.next(now)
+		}()
+	}
+	wg.Wait()
+	close(ids)
+
+	seen := map[string]bool{}
+	for id := range ids {
+		assert.False(t, seen[id], "duplicate id %s", id)
+		seen[id] = true
+	}
+	assert.Len(t, seen, 100)
+}
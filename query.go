@@ -0,0 +1,456 @@
+package firetest
+
+import (
+	"encoding/json"
+	"errors"
+	"net/url"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+var (
+	errOrderByRequired    = errors.New("orderBy must be defined when other query parameters are defined")
+	errInvalidOrderBy     = errors.New("orderBy must be a valid JSON encoded path")
+	errInvalidConstraint  = errors.New("Constraint index field must be a JSON primitive")
+	errKeyConstraint      = errors.New("When ordering by key, startAt, endAt and equalTo must be strings")
+	errPriorityConstraint = errors.New("When ordering by priority, startAt, endAt and equalTo must be a valid priority value (null, a number, or a string)")
+	errEqualToWithRange   = errors.New("equalTo cannot be specified in addition to startAt or endAt")
+	errInvalidLimitFirst  = errors.New("limitToFirst must be a positive integer")
+	errInvalidLimitLast   = errors.New("limitToLast must be a positive integer")
+	errLimitFirstAndLast  = errors.New("limitToFirst and limitToLast cannot both be specified")
+	errInvalidShallow     = errors.New("shallow must be either true or false")
+	errShallowWithQuery   = errors.New("Mixing 'shallow' and querying parameters is not supported")
+	errInvalidPrint       = errors.New("print must be either 'pretty' or 'silent'")
+	errInvalidFormat      = errors.New("format must be 'export'")
+	queryOrderingParams   = []string{"orderBy", "startAt", "endAt", "equalTo", "limitToFirst", "limitToLast"}
+)
+
+const (
+	printPretty = "pretty"
+	printSilent = "silent"
+
+	formatExport = "export"
+)
+
+const (
+	orderByKey      = "$key"
+	orderByValue    = "$value"
+	orderByPriority = "$priority"
+)
+
+// query holds the parsed ordering and filtering parameters
+// of a REST request.
+//
+// Reference https://www.firebase.com/docs/rest/guide/retrieving-data.html#section-rest-queries
+type query struct {
+	orderBy string
+
+	// startAt, endAt and equalTo are nil when they were not
+	// specified; a node holding no value represents null
+	startAt *node
+	endAt   *node
+	equalTo *node
+
+	limitToFirst int
+	limitToLast  int
+}
+
+// parseQuery reads the query parameters out of the given values.
+// A nil query is returned when no ordering parameters are present.
+func parseQuery(params url.Values) (*query, error) {
+	if !hasAnyParam(params, queryOrderingParams...) {
+		return nil, nil
+	}
+
+	if _, ok := params["orderBy"]; !ok {
+		return nil, errOrderByRequired
+	}
+
+	q := &query{}
+	if err := json.Unmarshal([]byte(params.Get("orderBy")), &q.orderBy); err != nil {
+		return nil, errInvalidOrderBy
+	}
+	q.orderBy = strings.Trim(q.orderBy, "/")
+	if q.orderBy == "" || (strings.HasPrefix(q.orderBy, "$") && !isOrderByVariable(q.orderBy)) {
+		return nil, errInvalidOrderBy
+	}
+
+	var err error
+	if q.startAt, err = q.parseConstraint(params, "startAt"); err != nil {
+		return nil, err
+	}
+	if q.endAt, err = q.parseConstraint(params, "endAt"); err != nil {
+		return nil, err
+	}
+	if q.equalTo, err = q.parseConstraint(params, "equalTo"); err != nil {
+		return nil, err
+	}
+	if q.equalTo != nil && (q.startAt != nil || q.endAt != nil) {
+		return nil, errEqualToWithRange
+	}
+
+	if q.limitToFirst, err = parseLimit(params, "limitToFirst", errInvalidLimitFirst); err != nil {
+		return nil, err
+	}
+	if q.limitToLast, err = parseLimit(params, "limitToLast", errInvalidLimitLast); err != nil {
+		return nil, err
+	}
+	if q.limitToFirst > 0 && q.limitToLast > 0 {
+		return nil, errLimitFirstAndLast
+	}
+
+	return q, nil
+}
+
+// parseShallow reports whether the shallow parameter was set
+// to true. Shallow reads cannot be combined with ordering.
+func parseShallow(params url.Values) (bool, error) {
+	if _, ok := params["shallow"]; !ok {
+		return false, nil
+	}
+
+	var shallow bool
+	switch params.Get("shallow") {
+	case "true":
+		shallow = true
+	case "false":
+	default:
+		return false, errInvalidShallow
+	}
+
+	if shallow && hasAnyParam(params, queryOrderingParams...) {
+		return false, errShallowWithQuery
+	}
+	return shallow, nil
+}
+
+// parsePrint returns the requested output format, if any.
+func parsePrint(params url.Values) (string, error) {
+	if _, ok := params["print"]; !ok {
+		return "", nil
+	}
+
+	mode := params.Get("print")
+	if mode != printPretty && mode != printSilent {
+		return "", errInvalidPrint
+	}
+	return mode, nil
+}
+
+// parseFormat reports whether the data should be
+// exported along with its priorities.
+func parseFormat(params url.Values) (bool, error) {
+	if _, ok := params["format"]; !ok {
+		return false, nil
+	}
+
+	if params.Get("format") != formatExport {
+		return false, errInvalidFormat
+	}
+	return true, nil
+}
+
+func hasAnyParam(params url.Values, names ...string) bool {
+	for _, name := range names {
+		if _, ok := params[name]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+func isOrderByVariable(orderBy string) bool {
+	return orderBy == orderByKey || orderBy == orderByValue || orderBy == orderByPriority
+}
+
+func (q *query) parseConstraint(params url.Values, name string) (*node, error) {
+	if _, ok := params[name]; !ok {
+		return nil, nil
+	}
+
+	v, err := decodeJSON([]byte(params.Get(name)))
+	if err != nil {
+		return nil, errInvalidConstraint
+	}
+
+	switch v.(type) {
+	case map[string]interface{}, []interface{}:
+		return nil, errInvalidConstraint
+	case string:
+	case bool:
+		switch q.orderBy {
+		case orderByKey:
+			return nil, errKeyConstraint
+		case orderByPriority:
+			return nil, errPriorityConstraint
+		}
+	default:
+		if q.orderBy == orderByKey {
+			return nil, errKeyConstraint
+		}
+	}
+	return newNode(v), nil
+}
+
+func parseLimit(params url.Values, name string, invalid error) (int, error) {
+	if _, ok := params[name]; !ok {
+		return 0, nil
+	}
+
+	limit, err := strconv.Atoi(params.Get(name))
+	if err != nil || limit <= 0 {
+		return 0, invalid
+	}
+	return limit, nil
+}
+
+// apply returns a node holding the children of n that
+// match the query. Nodes without children are returned as is.
+func (q *query) apply(n *node) *node {
+	if n == nil || len(n.children) == 0 {
+		return n
+	}
+
+	kids := q.sortedChildren(n)
+	kids = q.filter(kids)
+
+	result := &node{
+		priority: n.priority,
+		children: map[string]*node{},
+	}
+	for _, kid := range kids {
+		result.children[kid.key] = kid.node
+	}
+	return result
+}
+
+type queryChild struct {
+	key  string
+	node *node
+}
+
+// sortedChildren returns the children of n in the order
+// defined by the query's orderBy parameter.
+func (q *query) sortedChildren(n *node) []queryChild {
+	kids := make([]queryChild, 0, len(n.children))
+	for k, v := range n.children {
+		kids = append(kids, queryChild{key: k, node: v})
+	}
+	sort.Sort(byQuery{q: q, kids: kids})
+	return kids
+}
+
+// filter applies the range and limit constraints to
+// children that have already been sorted.
+func (q *query) filter(kids []queryChild) []queryChild {
+	start, end := q.startAt, q.endAt
+	if q.equalTo != nil {
+		start, end = q.equalTo, q.equalTo
+	}
+
+	filtered := make([]queryChild, 0, len(kids))
+	for _, kid := range kids {
+		if start != nil && q.compareTo(kid, start) < 0 {
+			continue
+		}
+		if end != nil && q.compareTo(kid, end) > 0 {
+			continue
+		}
+		filtered = append(filtered, kid)
+	}
+
+	switch {
+	case q.limitToFirst > 0 && len(filtered) > q.limitToFirst:
+		filtered = filtered[:q.limitToFirst]
+	case q.limitToLast > 0 && len(filtered) > q.limitToLast:
+		filtered = filtered[len(filtered)-q.limitToLast:]
+	}
+	return filtered
+}
+
+// orderValue returns the node whose value is used to
+// order the given child.
+func (q *query) orderValue(kid queryChild) *node {
+	switch q.orderBy {
+	case orderByValue:
+		return kid.node
+	case orderByPriority:
+		return &node{value: kid.node.priority}
+	default:
+		return kid.node.child(q.orderBy)
+	}
+}
+
+// compareTo compares the ordering value of a child against
+// a constraint value.
+func (q *query) compareTo(kid queryChild, constraint *node) int {
+	if q.orderBy == orderByKey {
+		key, _ := constraint.value.(string)
+		return compareKeys(kid.key, key)
+	}
+	return compareNodes(q.orderValue(kid), constraint)
+}
+
+type byQuery struct {
+	q    *query
+	kids []queryChild
+}
+
+func (b byQuery) Len() int      { return len(b.kids) }
+func (b byQuery) Swap(i, j int) { b.kids[i], b.kids[j] = b.kids[j], b.kids[i] }
+func (b byQuery) Less(i, j int) bool {
+	if b.q.orderBy != orderByKey {
+		c := compareNodes(b.q.orderValue(b.kids[i]), b.q.orderValue(b.kids[j]))
+		if c != 0 {
+			return c < 0
+		}
+	}
+	return compareKeys(b.kids[i].key, b.kids[j].key) < 0
+}
+
+// compareKeys orders keys the way Firebase does: keys that
+// are 32-bit integers come first in numeric order, followed
+// by all other keys in lexicographical order.
+func compareKeys(a, b string) int {
+	ai, aIsInt := integerKey(a)
+	bi, bIsInt := integerKey(b)
+	switch {
+	case aIsInt && bIsInt:
+		return compareInts(ai, bi)
+	case aIsInt:
+		return -1
+	case bIsInt:
+		return 1
+	}
+	return strings.Compare(a, b)
+}
+
+func integerKey(k string) (int64, bool) {
+	i, err := strconv.ParseInt(k, 10, 32)
+	if err != nil || strconv.FormatInt(i, 10) != k {
+		return 0, false
+	}
+	return i, true
+}
+
+func compareInts(a, b int64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+// Type ranks used when ordering values of different types
+const (
+	rankNull = iota
+	rankFalse
+	rankTrue
+	rankNumber
+	rankString
+	rankObject
+)
+
+func typeRank(n *node) int {
+	if n == nil || n.isNil() {
+		return rankNull
+	}
+	if len(n.children) > 0 {
+		return rankObject
+	}
+
+	switch v := n.value.(type) {
+	case bool:
+		if v {
+			return rankTrue
+		}
+		return rankFalse
+	case string:
+		return rankString
+	}
+	return rankNumber
+}
+
+// compareNodes orders two nodes by value following Firebase's
+// type ordering: null, false, true, numbers, strings and then
+// objects. Objects are considered equal to each other.
+func compareNodes(a, b *node) int {
+	ar, br := typeRank(a), typeRank(b)
+	if ar != br {
+		return compareInts(int64(ar), int64(br))
+	}
+
+	switch ar {
+	case rankNumber:
+		// integers too large for a float64 are still compared exactly
+		ai, aIsInt := toInt(a.value)
+		bi, bIsInt := toInt(b.value)
+		if aIsInt && bIsInt {
+			return compareInts(ai, bi)
+		}
+
+		af, bf := toFloat(a.value), toFloat(b.value)
+		switch {
+		case af < bf:
+			return -1
+		case af > bf:
+			return 1
+		}
+	case rankString:
+		return strings.Compare(a.value.(string), b.value.(string))
+	}
+	return 0
+}
+
+// liveQuery keeps the result of a query up to date
+// for a stream opened with query parameters
+type liveQuery struct {
+	q    *query
+	view *node
+}
+
+func newLiveQuery(q *query, n *node) *liveQuery {
+	return &liveQuery{q: q, view: q.apply(n)}
+}
+
+// update applies the query to the new data and returns the event
+// describing how the result changed, if it did. A single changed
+// child is sent as a put of that child, while several are sent
+// as a patch, with null for the children that left the result.
+func (lq *liveQuery) update(n *node) (event, bool) {
+	prev, next := lq.view, lq.q.apply(n)
+	lq.view = next
+
+	if prev.isNil() || next.isNil() || len(prev.children) == 0 || len(next.children) == 0 {
+		if reflect.DeepEqual(prev.export(), next.export()) {
+			return event{}, false
+		}
+		return newEvent(eventPut, "", next), true
+	}
+
+	changed := &node{children: map[string]*node{}}
+	for k, child := range next.children {
+		if old, ok := prev.children[k]; !ok || !reflect.DeepEqual(old.export(), child.export()) {
+			changed.children[k] = child
+		}
+	}
+	for k := range prev.children {
+		if _, ok := next.children[k]; !ok {
+			changed.children[k] = nil
+		}
+	}
+
+	switch len(changed.children) {
+	case 0:
+		return event{}, false
+	case 1:
+		for k, child := range changed.children {
+			return newEvent(eventPut, k, child), true
+		}
+	}
+	return newEvent(eventPatch, "", changed), true
+}
@@ -0,0 +1,372 @@
+package firetest
+
+import (
+	"encoding/json"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseQuery(t *testing.T) {
+	for _, test := range []struct {
+		name   string
+		params string
+		query  *query
+		err    error
+	}{
+		{
+			name:   "no params",
+			params: "auth=foo",
+		},
+		{
+			name:   "order by key",
+			params: `orderBy="$key"&limitToFirst=2`,
+			query:  &query{orderBy: "$key", limitToFirst: 2},
+		},
+		{
+			name:   "order by child path",
+			params: `orderBy="/dimensions/height/"&startAt=3&endAt=5`,
+			query:  &query{orderBy: "dimensions/height", startAt: newNode(3.0), endAt: newNode(5.0)},
+		},
+		{
+			name:   "equalTo null",
+			params: `orderBy="$value"&equalTo=null`,
+			query:  &query{orderBy: "$value", equalTo: newNode(nil)},
+		},
+		{
+			name:   "missing orderBy",
+			params: "limitToFirst=1",
+			err:    errOrderByRequired,
+		},
+		{
+			name:   "unquoted orderBy",
+			params: "orderBy=$key",
+			err:    errInvalidOrderBy,
+		},
+		{
+			name:   "unknown variable",
+			params: `orderBy="$foo"`,
+			err:    errInvalidOrderBy,
+		},
+		{
+			name:   "object constraint",
+			params: `orderBy="$value"&startAt={"a":1}`,
+			err:    errInvalidConstraint,
+		},
+		{
+			name:   "unquoted constraint",
+			params: `orderBy="$value"&startAt=foo`,
+			err:    errInvalidConstraint,
+		},
+		{
+			name:   "number constraint when ordering by key",
+			params: `orderBy="$key"&startAt=1`,
+			err:    errKeyConstraint,
+		},
+		{
+			name:   "boolean constraint when ordering by priority",
+			params: `orderBy="$priority"&startAt=true`,
+			err:    errPriorityConstraint,
+		},
+		{
+			name:   "equalTo with range",
+			params: `orderBy="$value"&equalTo=1&endAt=2`,
+			err:    errEqualToWithRange,
+		},
+		{
+			name:   "negative limit",
+			params: `orderBy="$key"&limitToFirst=-1`,
+			err:    errInvalidLimitFirst,
+		},
+		{
+			name:   "non numeric limit",
+			params: `orderBy="$key"&limitToLast=a`,
+			err:    errInvalidLimitLast,
+		},
+		{
+			name:   "both limits",
+			params: `orderBy="$key"&limitToFirst=1&limitToLast=1`,
+			err:    errLimitFirstAndLast,
+		},
+	} {
+		params, err := url.ParseQuery(test.params)
+		require.NoError(t, err, test.name)
+
+		q, err := parseQuery(params)
+		assert.Equal(t, test.err, err, test.name)
+		assert.Equal(t, test.query, q, test.name)
+	}
+}
+
+func TestQueryApply(t *testing.T) {
+	data := map[string]interface{}{
+		"lambeosaurus": map[string]interface{}{"height": 2.1, "order": "ornithischia"},
+		"linhenykus":   map[string]interface{}{"height": 0.6, "order": "theropoda"},
+		"pterodactyl":  map[string]interface{}{"height": 0.6, "order": "pterosauria"},
+		"stegosaurus":  map[string]interface{}{"height": 4, "order": "ornithischia"},
+		"triceratops":  map[string]interface{}{"height": 3, "order": "ornithischia"},
+		"unknown":      map[string]interface{}{"order": "unknown"},
+	}
+
+	for _, test := range []struct {
+		name     string
+		params   string
+		expected []string
+	}{
+		{
+			name:     "order by key",
+			params:   `orderBy="$key"&limitToFirst=2`,
+			expected: []string{"lambeosaurus", "linhenykus"},
+		},
+		{
+			name:     "order by key range",
+			params:   `orderBy="$key"&startAt="p"&endAt="t"`,
+			expected: []string{"pterodactyl", "stegosaurus"},
+		},
+		{
+			name:     "order by child first",
+			params:   `orderBy="height"&limitToFirst=2`,
+			expected: []string{"unknown", "linhenykus"},
+		},
+		{
+			name:     "order by child last",
+			params:   `orderBy="height"&limitToLast=2`,
+			expected: []string{"stegosaurus", "triceratops"},
+		},
+		{
+			name:     "order by child range",
+			params:   `orderBy="height"&startAt=0.6&endAt=2.1`,
+			expected: []string{"lambeosaurus", "linhenykus", "pterodactyl"},
+		},
+		{
+			name:     "order by child equalTo",
+			params:   `orderBy="order"&equalTo="ornithischia"&limitToLast=2`,
+			expected: []string{"stegosaurus", "triceratops"},
+		},
+		{
+			name:     "missing children are null",
+			params:   `orderBy="height"&equalTo=null`,
+			expected: []string{"unknown"},
+		},
+	} {
+		params, err := url.ParseQuery(test.params)
+		require.NoError(t, err, test.name)
+		q, err := parseQuery(params)
+		require.NoError(t, err, test.name)
+
+		v := q.apply(newNode(data)).objectify()
+		obj, ok := v.(map[string]interface{})
+		require.True(t, ok, test.name)
+
+		assert.Len(t, obj, len(test.expected), test.name)
+		for _, k := range test.expected {
+			assert.Equal(t, jsonNumbers(data[k]), obj[k], test.name)
+		}
+	}
+}
+
+func TestQueryApplyValue(t *testing.T) {
+	data := map[string]interface{}{
+		"a": "foo",
+		"b": 10,
+		"c": true,
+		"d": false,
+		"e": map[string]interface{}{"foo": "bar"},
+		"f": 2.5,
+	}
+	q := &query{orderBy: "$value", limitToFirst: 3}
+	assert.Equal(t, map[string]interface{}{"c": true, "d": false, "f": json.Number("2.5")}, q.apply(newNode(data)).objectify())
+
+	q = &query{orderBy: "$value", startAt: newNode("a")}
+	assert.Equal(t, map[string]interface{}{"a": "foo", "e": data["e"]}, q.apply(newNode(data)).objectify())
+
+	q = &query{orderBy: "$value"}
+	assert.Equal(t, "foo", q.apply(newNode("foo")).objectify())
+	assert.Nil(t, q.apply(nil))
+}
+
+func TestQueryApplyPriority(t *testing.T) {
+	data := map[string]interface{}{
+		"a": map[string]interface{}{".value": 1, ".priority": "z"},
+		"b": map[string]interface{}{".value": 2, ".priority": 10},
+		"c": map[string]interface{}{".value": 3, ".priority": 5},
+		"d": 4,
+		"e": map[string]interface{}{"foo": "bar", ".priority": "a"},
+	}
+
+	q := &query{orderBy: "$priority", limitToFirst: 2}
+	assert.Equal(t, map[string]interface{}{"c": json.Number("3"), "d": json.Number("4")}, q.apply(newNode(data)).objectify())
+
+	q = &query{orderBy: "$priority", startAt: newNode(6)}
+	assert.Equal(t, map[string]interface{}{
+		"a": json.Number("1"),
+		"b": json.Number("2"),
+		"e": map[string]interface{}{"foo": "bar"},
+	}, q.apply(newNode(data)).objectify())
+
+	q = &query{orderBy: "$priority", equalTo: newNode(nil)}
+	assert.Equal(t, map[string]interface{}{"d": json.Number("4")}, q.apply(newNode(data)).objectify())
+}
+
+func TestCompareKeys(t *testing.T) {
+	for _, test := range []struct {
+		a, b     string
+		expected int
+	}{
+		{"1", "2", -1},
+		{"2", "10", -1},
+		{"-5", "1", -1},
+		{"10", "a", -1},
+		{"a", "b", -1},
+		{"01", "1", 1},
+		{"2147483648", "a", -1},
+		{"2147483647", "2147483648", -1},
+		{"a", "a", 0},
+	} {
+		assert.Equal(t, test.expected, compareKeys(test.a, test.b), "%s vs %s", test.a, test.b)
+		assert.Equal(t, -test.expected, compareKeys(test.b, test.a), "%s vs %s", test.b, test.a)
+	}
+}
+
+func TestCompareNodes(t *testing.T) {
+	ordered := []*node{
+		nil,
+		newNode(false),
+		newNode(true),
+		newNode(-1),
+		newNode(2.5),
+		newNode(3),
+		newNode(json.Number("9007199254740992")),
+		newNode(json.Number("9007199254740993")),
+		newNode(""),
+		newNode("a"),
+		newNode(map[string]interface{}{"a": 1}),
+	}
+
+	for i := 0; i < len(ordered)-1; i++ {
+		assert.Equal(t, -1, compareNodes(ordered[i], ordered[i+1]), "%d", i)
+		assert.Equal(t, 1, compareNodes(ordered[i+1], ordered[i]), "%d", i)
+	}
+	assert.Equal(t, 0, compareNodes(newNode(nil), nil))
+	assert.Equal(t, 0, compareNodes(newNode(2), newNode(2.0)))
+}
+
+func TestParseShallow(t *testing.T) {
+	for _, test := range []struct {
+		params  string
+		shallow bool
+		err     error
+	}{
+		{params: ""},
+		{params: "shallow=true", shallow: true},
+		{params: "shallow=false"},
+		{params: "shallow=1", err: errInvalidShallow},
+		{params: `shallow=true&orderBy="$key"`, err: errShallowWithQuery},
+		{params: `shallow=false&orderBy="$key"`},
+	} {
+		params, err := url.ParseQuery(test.params)
+		require.NoError(t, err, test.params)
+
+		shallow, err := parseShallow(params)
+		assert.Equal(t, test.err, err, test.params)
+		assert.Equal(t, test.shallow, shallow, test.params)
+	}
+}
+
+func TestParsePrint(t *testing.T) {
+	for _, test := range []struct {
+		params string
+		mode   string
+		err    error
+	}{
+		{params: ""},
+		{params: "print=pretty", mode: printPretty},
+		{params: "print=silent", mode: printSilent},
+		{params: "print=loud", err: errInvalidPrint},
+	} {
+		params, err := url.ParseQuery(test.params)
+		require.NoError(t, err, test.params)
+
+		mode, err := parsePrint(params)
+		assert.Equal(t, test.err, err, test.params)
+		assert.Equal(t, test.mode, mode, test.params)
+	}
+}
+
+func TestParseFormat(t *testing.T) {
+	for _, test := range []struct {
+		params string
+		export bool
+		err    error
+	}{
+		{params: ""},
+		{params: "format=export", export: true},
+		{params: "format=json", err: errInvalidFormat},
+	} {
+		params, err := url.ParseQuery(test.params)
+		require.NoError(t, err, test.params)
+
+		export, err := parseFormat(params)
+		assert.Equal(t, test.err, err, test.params)
+		assert.Equal(t, test.export, export, test.params)
+	}
+}
+
+func TestLiveQuery(t *testing.T) {
+	q, err := parseQuery(url.Values{"orderBy": {`"$value"`}, "limitToLast": {"2"}})
+	require.NoError(t, err)
+
+	lq := newLiveQuery(q, newNode(map[string]interface{}{"a": 1, "b": 2, "c": 3}))
+	assert.Equal(t, map[string]interface{}{"b": json.Number("2"), "c": json.Number("3")}, lq.view.objectify())
+
+	for _, test := range []struct {
+		name  string
+		data  interface{}
+		event string
+		path  string
+		value interface{}
+	}{
+		{
+			name:  "child enters and leaves the window",
+			data:  map[string]interface{}{"a": 5, "b": 2, "c": 3},
+			event: "patch",
+			value: map[string]interface{}{"a": 5, "b": nil},
+		},
+		{
+			name:  "child changes inside the window",
+			data:  map[string]interface{}{"a": 5, "b": 2, "c": 4},
+			event: "put",
+			path:  "c",
+			value: 4,
+		},
+		{
+			name: "child changes outside the window",
+			data: map[string]interface{}{"a": 5, "b": 0, "c": 4},
+		},
+		{
+			name:  "priority changes inside the window",
+			data:  map[string]interface{}{"a": 5, "b": 0, "c": map[string]interface{}{".value": 4, ".priority": 1}},
+			event: "put",
+			path:  "c",
+			value: 4,
+		},
+		{
+			name:  "data removed",
+			event: "put",
+		},
+		{
+			name:  "data added",
+			data:  map[string]interface{}{"a": 1},
+			event: "put",
+			value: map[string]interface{}{"a": 1},
+		},
+	} {
+		e, ok := lq.update(newNode(test.data))
+		assert.Equal(t, test.event != "", ok, test.name)
+		assert.Equal(t, test.event, e.Name, test.name)
+		assert.Equal(t, test.path, e.Data.Path, test.name)
+		assert.Equal(t, jsonNumbers(test.value), e.Data.Data.objectify(), test.name)
+	}
+}
@@ -0,0 +1,674 @@
+package firetest
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync/atomic"
+)
+
+var (
+	errMissingRules = errors.New(`rules must be an object under the "rules" key`)
+	errUndefinedVar = errors.New("variable is not defined")
+)
+
+// rules is a parsed Firebase security rules document.
+//
+// Reference https://www.firebase.com/docs/security/guide/understanding-security.html
+type rules struct {
+	source []byte
+	root   *ruleNode
+
+	// all lists every rule in the document
+	all []*rule
+}
+
+// rule is a single .read, .write or .validate expression
+type rule struct {
+	// evaluation counters used for coverage reports, which
+	// are first to guarantee alignment for atomic access
+	trueCount  int64
+	falseCount int64
+	errorCount int64
+
+	// location of the rule in the rules document,
+	// e.g. /rules/users/$uid/.read
+	location string
+	line     int
+	source   string
+	expr     expr
+}
+
+// ruleNode holds the rules that apply to a location
+type ruleNode struct {
+	read     *rule
+	write    *rule
+	validate *rule
+
+	// indexOn holds the children, or .value,
+	// the data at this location can be ordered by
+	indexOn []string
+
+	children map[string]*ruleNode
+
+	// wildcard is the name of the $variable capturing
+	// keys that do not match any of the children
+	wildcard     string
+	wildcardNode *ruleNode
+}
+
+// parseRules parses a rules document. Comments are
+// allowed, just like in the Firebase console.
+func parseRules(source []byte) (*rules, error) {
+	var doc map[string]interface{}
+	if err := json.Unmarshal(stripComments(source), &doc); err != nil {
+		return nil, err
+	}
+
+	v, ok := doc["rules"].(map[string]interface{})
+	if !ok {
+		return nil, errMissingRules
+	}
+
+	root, err := newRuleNode("/rules", v)
+	if err != nil {
+		return nil, err
+	}
+
+	r := &rules{source: source, root: root}
+	lines := ruleLines(stripComments(source))
+	r.all = root.collect(nil)
+	for _, rule := range r.all {
+		rule.line = lines[rule.location]
+	}
+	return r, nil
+}
+
+func newRuleNode(location string, v map[string]interface{}) (*ruleNode, error) {
+	rn := &ruleNode{children: map[string]*ruleNode{}}
+
+	// sort the keys so errors are reported consistently
+	keys := make([]string, 0, len(v))
+	for k := range v {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		loc := location + "/" + k
+
+		var err error
+		switch {
+		case k == ".read":
+			rn.read, err = newRule(loc, v[k])
+		case k == ".write":
+			rn.write, err = newRule(loc, v[k])
+		case k == ".validate":
+			rn.validate, err = newRule(loc, v[k])
+		case k == ".indexOn":
+			rn.indexOn, err = newIndex(loc, v[k])
+		case strings.HasPrefix(k, "."):
+			err = fmt.Errorf("%s: invalid key %s", location, k)
+		default:
+			children, ok := v[k].(map[string]interface{})
+			if !ok {
+				return nil, fmt.Errorf("%s: expected an object", loc)
+			}
+
+			var child *ruleNode
+			if child, err = newRuleNode(loc, children); err != nil {
+				return nil, err
+			}
+			if !strings.HasPrefix(k, "$") {
+				rn.children[k] = child
+				break
+			}
+			if rn.wildcard != "" {
+				return nil, fmt.Errorf("%s: can have only one $ location, found %s and %s", location, rn.wildcard, k)
+			}
+			rn.wildcard, rn.wildcardNode = k, child
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return rn, nil
+}
+
+func newRule(location string, v interface{}) (*rule, error) {
+	switch v := v.(type) {
+	case bool:
+		return &rule{location: location, source: fmt.Sprint(v), expr: literalExpr{value: v}}, nil
+	case string:
+		e, err := parseExpr(v)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", location, err)
+		}
+		return &rule{location: location, source: v, expr: e}, nil
+	}
+	return nil, fmt.Errorf("%s: expected a boolean or a string", location)
+}
+
+// newIndex parses the value of an .indexOn key, which
+// is either a single key or an array of keys
+func newIndex(location string, v interface{}) ([]string, error) {
+	switch v := v.(type) {
+	case string:
+		return []string{v}, nil
+	case []interface{}:
+		index := make([]string, len(v))
+		for i, k := range v {
+			s, ok := k.(string)
+			if !ok {
+				return nil, fmt.Errorf("%s: expected a string or an array of strings", location)
+			}
+			index[i] = s
+		}
+		return index, nil
+	}
+	return nil, fmt.Errorf("%s: expected a string or an array of strings", location)
+}
+
+// checkIndex returns an error if the data at path cannot be ordered
+// as q requires because the rules do not define an index for it.
+// Ordering by key or by priority does not need an index.
+//
+// Reference https://www.firebase.com/docs/security/guide/indexing-data.html
+func (r *rules) checkIndex(path string, q *query) error {
+	if q == nil || q.orderBy == orderByKey || q.orderBy == orderByPriority {
+		return nil
+	}
+
+	key := q.orderBy
+	if key == orderByValue {
+		key = valueKey
+	}
+
+	rn := r.root
+	for _, seg := range splitPath(path) {
+		next, ok := rn.children[seg]
+		if !ok {
+			next = rn.wildcardNode
+		}
+		if next == nil {
+			rn = nil
+			break
+		}
+		rn = next
+	}
+
+	if rn != nil {
+		for _, k := range rn.indexOn {
+			if k == key {
+				return nil
+			}
+		}
+	}
+	return fmt.Errorf(`Index not defined, add ".indexOn": "%s", for path "/%s", to the rules`, key, path)
+}
+
+// collect appends all the rules defined at and under rn to list
+func (rn *ruleNode) collect(list []*rule) []*rule {
+	for _, r := range []*rule{rn.read, rn.write, rn.validate} {
+		if r != nil {
+			list = append(list, r)
+		}
+	}
+	for _, child := range rn.children {
+		list = child.collect(list)
+	}
+	if rn.wildcardNode != nil {
+		list = rn.wildcardNode.collect(list)
+	}
+	return list
+}
+
+// next returns the rules that apply to the child key, recording
+// the key in vars if it was matched by a wildcard.
+func (rn *ruleNode) next(key string, vars map[string]string) *ruleNode {
+	if child, ok := rn.children[key]; ok {
+		return child
+	}
+	if rn.wildcardNode != nil {
+		vars[rn.wildcard] = key
+	}
+	return rn.wildcardNode
+}
+
+// stripComments blanks out JavaScript style comments that are not
+// part of a string. Comments are replaced with spaces so offsets in
+// the result match the ones in the source.
+func stripComments(src []byte) []byte {
+	out := append([]byte{}, src...)
+	blank := func(from, to int) {
+		for i := from; i < to; i++ {
+			if out[i] != '\n' {
+				out[i] = ' '
+			}
+		}
+	}
+
+	for i := 0; i < len(src); i++ {
+		switch {
+		case src[i] == '"':
+			for i++; i < len(src) && src[i] != '"'; i++ {
+				if src[i] == '\\' {
+					i++
+				}
+			}
+		case src[i] == '/' && i+1 < len(src) && src[i+1] == '/':
+			end := i
+			for end < len(src) && src[end] != '\n' {
+				end++
+			}
+			blank(i, end)
+			i = end
+		case src[i] == '/' && i+1 < len(src) && src[i+1] == '*':
+			end := strings.Index(string(src[i+2:]), "*/")
+			if end < 0 {
+				blank(i, len(src))
+				return out
+			}
+			blank(i, i+end+4)
+			i += end + 3
+		}
+	}
+	return out
+}
+
+// ruleEnv holds the variables available to rule expressions
+type ruleEnv struct {
+	auth interface{}
+	now  int64
+
+	// root is the data before the operation and newRoot
+	// is the data after it; newRoot is nil for reads
+	root    *node
+	newRoot *node
+
+	path []string
+	vars map[string]string
+
+	// observe, if set, is called after every rule evaluation
+	observe func(r *rule, env *ruleEnv, allowed bool, err error)
+}
+
+// location returns the data location the rules are evaluated at
+func (env *ruleEnv) location() string {
+	return "/" + strings.Join(env.path, "/")
+}
+
+func (env *ruleEnv) lookup(name string) (interface{}, error) {
+	switch name {
+	case "auth":
+		return env.auth, nil
+	case "now":
+		return float64(env.now), nil
+	case "root":
+		return snapshot{root: env.root}, nil
+	case "data":
+		return snapshot{root: env.root, path: env.path}, nil
+	case "newData":
+		if env.newRoot == nil {
+			return nil, fmt.Errorf("newData: %v", errUndefinedVar)
+		}
+		return snapshot{root: env.newRoot, path: env.path}, nil
+	}
+
+	if v, ok := env.vars[name]; ok {
+		return v, nil
+	}
+	return nil, fmt.Errorf("%s: %v", name, errUndefinedVar)
+}
+
+// allows evaluates the rule at the given location, treating
+// errors and non boolean results as a denial.
+func (r *rule) allows(env *ruleEnv) bool {
+	if r == nil {
+		return false
+	}
+
+	v, err := r.expr.eval(env)
+	b, ok := v.(bool)
+	if err == nil && !ok {
+		err = fmt.Errorf("rule evaluated to %s instead of a boolean", ruleString(v))
+	}
+
+	switch {
+	case err != nil:
+		atomic.AddInt64(&r.errorCount, 1)
+	case b:
+		atomic.AddInt64(&r.trueCount, 1)
+	default:
+		atomic.AddInt64(&r.falseCount, 1)
+	}
+	if env.observe != nil {
+		env.observe(r, env, b, err)
+	}
+	return b && err == nil
+}
+
+// ruleDecision is the outcome of evaluating the rules for an operation
+type ruleDecision struct {
+	allowed bool
+
+	// rule is the rule that decided the outcome, which is nil
+	// when access was denied because no rule granted it
+	rule *rule
+
+	// location is where rule was evaluated or, when there
+	// is no deciding rule, where access was requested
+	location string
+}
+
+// reason explains the decision in a human readable way
+func (d ruleDecision) reason(op string) string {
+	switch {
+	case d.allowed && d.rule == nil:
+		return "no security rules are loaded"
+	case d.allowed:
+		return fmt.Sprintf("%s access granted by %s at %s", op, d.rule.location, d.location)
+	case d.rule == nil:
+		return fmt.Sprintf("no .%s rule granted access to %s", op, d.location)
+	}
+	return fmt.Sprintf("validation failed by %s at %s", d.rule.location, d.location)
+}
+
+// canRead reports whether the location can be read.
+func (r *rules) canRead(env *ruleEnv, path string) bool {
+	return r.read(env, path).allowed
+}
+
+// read decides whether the location can be read. Read access
+// cascades: a rule granting access to a location grants access
+// to every location under it.
+func (r *rules) read(env *ruleEnv, path string) ruleDecision {
+	return r.cascade(env, path, func(rn *ruleNode) *rule { return rn.read })
+}
+
+// write decides whether env.newRoot can be written at the
+// location. Write access cascades like read access and, once
+// granted, every .validate rule affected by the write must
+// also pass.
+func (r *rules) write(env *ruleEnv, path string) ruleDecision {
+	d := r.cascade(env, path, func(rn *ruleNode) *rule { return rn.write })
+	if !d.allowed {
+		return d
+	}
+
+	if failed := r.validate(env, path); failed != nil {
+		return ruleDecision{rule: failed, location: env.location()}
+	}
+	return d
+}
+
+// writeAt applies change to the node at path and decides whether the
+// result can be written at each of the locations, which default to
+// the path itself.
+func (r *rules) writeAt(env *ruleEnv, path string, change func(*node) *node, locations ...string) ruleDecision {
+	env.newRoot = applyWrite(env.root, path, change)
+	if len(locations) == 0 {
+		locations = []string{path}
+	}
+
+	var d ruleDecision
+	for _, l := range locations {
+		if d = r.write(env, l); !d.allowed {
+			break
+		}
+	}
+	return d
+}
+
+func (r *rules) cascade(env *ruleEnv, path string, pick func(*ruleNode) *rule) ruleDecision {
+	segments := splitPath(path)
+	env.vars = map[string]string{}
+
+	rn := r.root
+	for i := 0; ; i++ {
+		env.path = segments[:i]
+		if rule := pick(rn); rule.allows(env) {
+			return ruleDecision{allowed: true, rule: rule, location: env.location()}
+		}
+
+		if i == len(segments) {
+			break
+		}
+		if rn = rn.next(segments[i], env.vars); rn == nil {
+			break
+		}
+	}
+	return ruleDecision{location: "/" + path}
+}
+
+// validate checks the .validate rules of the location, its
+// ancestors and all of its descendants in the new data. It
+// returns the first rule that failed, leaving env at the
+// location the rule was evaluated at.
+func (r *rules) validate(env *ruleEnv, path string) *rule {
+	segments := splitPath(path)
+	env.vars = map[string]string{}
+
+	rn := r.root
+	for i := 0; ; i++ {
+		env.path = segments[:i]
+		if !r.validateNode(env, rn) {
+			return rn.validate
+		}
+
+		if i == len(segments) {
+			break
+		}
+		if rn = rn.next(segments[i], env.vars); rn == nil {
+			return nil
+		}
+	}
+	return r.validateChildren(env, rn)
+}
+
+func (r *rules) validateNode(env *ruleEnv, rn *ruleNode) bool {
+	if rn.validate == nil {
+		return true
+	}
+
+	// validation is skipped when data is being deleted
+	if env.newRoot.child(strings.Join(env.path, "/")).isNil() {
+		return true
+	}
+	return rn.validate.allows(env)
+}
+
+func (r *rules) validateChildren(env *ruleEnv, rn *ruleNode) *rule {
+	n := env.newRoot.child(strings.Join(env.path, "/"))
+	if n == nil {
+		return nil
+	}
+
+	path, vars := env.path, env.vars
+	for k := range n.children {
+		env.path = append(path[:len(path):len(path)], k)
+		env.vars = copyVars(vars)
+
+		child := rn.next(k, env.vars)
+		if child == nil {
+			continue
+		}
+		if !r.validateNode(env, child) {
+			return child.validate
+		}
+		if failed := r.validateChildren(env, child); failed != nil {
+			return failed
+		}
+	}
+
+	env.path, env.vars = path, vars
+	return nil
+}
+
+func copyVars(vars map[string]string) map[string]string {
+	cp := make(map[string]string, len(vars))
+	for k, v := range vars {
+		cp[k] = v
+	}
+	return cp
+}
+
+func splitPath(path string) []string {
+	if path == "" {
+		return nil
+	}
+	return strings.Split(path, "/")
+}
+
+// snapshot is the value of the data, newData and root
+// rule variables.
+//
+// Reference https://www.firebase.com/docs/security/api/rule/data.html
+type snapshot struct {
+	root *node
+	path []string
+}
+
+func (s snapshot) node() *node {
+	return s.root.child(strings.Join(s.path, "/"))
+}
+
+func (s snapshot) method(name string) (ruleFunc, bool) {
+	var fn ruleFunc
+	switch name {
+	case "val":
+		fn = func([]interface{}) (interface{}, error) {
+			return s.node().objectify(), nil
+		}
+	case "child":
+		fn = func(args []interface{}) (interface{}, error) {
+			p, err := stringArg(name, args, 0)
+			if err != nil {
+				return nil, err
+			}
+			return s.child(p), nil
+		}
+	case "parent":
+		fn = func([]interface{}) (interface{}, error) {
+			if len(s.path) == 0 {
+				return nil, nil
+			}
+			return snapshot{root: s.root, path: s.path[:len(s.path)-1]}, nil
+		}
+	case "exists":
+		fn = func([]interface{}) (interface{}, error) {
+			return !s.node().isNil(), nil
+		}
+	case "hasChild":
+		fn = func(args []interface{}) (interface{}, error) {
+			p, err := stringArg(name, args, 0)
+			if err != nil {
+				return nil, err
+			}
+			return !s.child(p).node().isNil(), nil
+		}
+	case "hasChildren":
+		fn = s.hasChildren
+	case "isString", "isNumber", "isBoolean":
+		fn = func([]interface{}) (interface{}, error) {
+			n := s.node()
+			if n.isNil() || len(n.children) > 0 {
+				return false, nil
+			}
+
+			switch name {
+			case "isString":
+				_, ok := n.value.(string)
+				return ok, nil
+			case "isBoolean":
+				_, ok := n.value.(bool)
+				return ok, nil
+			}
+			return isNumber(n.value), nil
+		}
+	case "getPriority":
+		fn = func([]interface{}) (interface{}, error) {
+			n := s.node()
+			if n.isNil() {
+				return nil, nil
+			}
+			return n.priority, nil
+		}
+	default:
+		return nil, false
+	}
+	return fn, true
+}
+
+func (s snapshot) child(path string) snapshot {
+	kid := snapshot{root: s.root, path: append([]string{}, s.path...)}
+	for _, step := range strings.Split(path, "/") {
+		if step != "" {
+			kid.path = append(kid.path, step)
+		}
+	}
+	return kid
+}
+
+func (s snapshot) hasChildren(args []interface{}) (interface{}, error) {
+	n := s.node()
+	if len(args) == 0 {
+		return !n.isNil() && len(n.children) > 0, nil
+	}
+
+	keys, ok := args[0].([]interface{})
+	if !ok {
+		return nil, errors.New("hasChildren requires an array of keys")
+	}
+	for _, k := range keys {
+		p, ok := k.(string)
+		if !ok {
+			return nil, errors.New("hasChildren requires an array of keys")
+		}
+		if s.child(p).node().isNil() {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// applyWrite returns a copy of root where the node at path has
+// been replaced by the result of calling change with the
+// current node. Only the nodes along the path are copied.
+// A result without data deletes the node, along with the
+// ancestors it leaves without data, just like the tree does.
+func applyWrite(root *node, path string, change func(*node) *node) *node {
+	segments := splitPath(path)
+	if len(segments) == 0 {
+		if n := change(root); !n.isNil() {
+			return n
+		}
+		return &node{children: map[string]*node{}}
+	}
+
+	newRoot := root.copy()
+	parents := []*node{newRoot}
+	for _, step := range segments[:len(segments)-1] {
+		next := parents[len(parents)-1].children[step].copy()
+		parents[len(parents)-1].children[step] = next
+		parents = append(parents, next)
+	}
+
+	last := segments[len(segments)-1]
+	parent := parents[len(parents)-1]
+	if n := change(parent.children[last]); !n.isNil() {
+		for _, p := range parents[1:] {
+			p.value = nil // no longer has a value since it now has a child
+		}
+		parent.children[last] = n
+		return newRoot
+	}
+
+	delete(parent.children, last)
+	for i := len(parents) - 1; i > 0 && parents[i].isNil(); i-- {
+		delete(parents[i-1].children, segments[i-1])
+	}
+	return newRoot
+}
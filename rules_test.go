@@ -0,0 +1,261 @@
+package firetest
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testRules = `{
+  // comments are allowed
+  "rules": {
+    ".read": "auth != null && auth.admin === true",
+    "public": {
+      ".read": true,
+      /* but nobody can write */
+      ".write": false
+    },
+    "users": {
+      "$uid": {
+        ".read": "auth != null && auth.uid === $uid",
+        ".write": "auth != null && auth.uid === $uid",
+        ".validate": "newData.hasChildren(['name'])",
+        "name": {
+          ".validate": "newData.isString() && newData.val().length < 10"
+        },
+        "age": {
+          ".validate": "newData.isNumber()"
+        },
+        "$other": {
+          ".validate": false
+        }
+      }
+    },
+    "messages": {
+      ".indexOn": ["createdAt"],
+      "$id": {
+        ".write": "!data.exists() && newData.child('author').val() === auth.uid",
+        "createdAt": {
+          ".validate": "newData.val() <= now"
+        }
+      }
+    }
+  }
+}`
+
+func TestParseRules(t *testing.T) {
+	r, err := parseRules([]byte(testRules))
+	require.NoError(t, err)
+	assert.Equal(t, []byte(testRules), r.source)
+
+	require.NotNil(t, r.root.read)
+	assert.Equal(t, "/rules/.read", r.root.read.location)
+	assert.Equal(t, "auth != null && auth.admin === true", r.root.read.source)
+
+	users := r.root.children["users"]
+	require.NotNil(t, users)
+	assert.Equal(t, "$uid", users.wildcard)
+	assert.Equal(t, "/rules/users/$uid/name/.validate", users.wildcardNode.children["name"].validate.location)
+	assert.Equal(t, "$other", users.wildcardNode.wildcard)
+	assert.Equal(t, "false", users.wildcardNode.wildcardNode.validate.source)
+	assert.Equal(t, []string{"createdAt"}, r.root.children["messages"].indexOn)
+}
+
+func TestParseRulesErrors(t *testing.T) {
+	for _, src := range []string{
+		`not json`,
+		`{}`,
+		`{"rules": true}`,
+		`{"rules": {".read": 1}}`,
+		`{"rules": {".read": "auth !=="}}`,
+		`{"rules": {".foo": true}}`,
+		`{"rules": {"foo": true}}`,
+		`{"rules": {"$a": {}, "$b": {}}}`,
+		`{"rules": {".indexOn": 1}}`,
+		`{"rules": {".indexOn": ["a", 1]}}`,
+	} {
+		_, err := parseRules([]byte(src))
+		assert.Error(t, err, src)
+	}
+}
+
+func TestRulesCheckIndex(t *testing.T) {
+	r, err := parseRules([]byte(`{"rules": {
+		"messages": {".indexOn": ["createdAt", "author"]},
+		"scores": {".indexOn": ".value"},
+		"users": {"$uid": {"posts": {".indexOn": "title"}}}
+	}}`))
+	require.NoError(t, err)
+
+	for _, test := range []struct {
+		path    string
+		orderBy string
+		ok      bool
+	}{
+		{"messages", "createdAt", true},
+		{"messages", "author", true},
+		{"messages", "text", false},
+		{"messages", orderByKey, true},
+		{"messages", orderByPriority, true},
+		{"messages", orderByValue, false},
+		{"scores", orderByValue, true},
+		{"users/alice/posts", "title", true},
+		{"users/alice", "title", false},
+		{"nope", "title", false},
+	} {
+		err := r.checkIndex(test.path, &query{orderBy: test.orderBy})
+		assert.Equal(t, test.ok, err == nil, "%s %s", test.path, test.orderBy)
+	}
+	assert.NoError(t, r.checkIndex("messages", nil))
+
+	err = r.checkIndex("messages", &query{orderBy: "text"})
+	assert.EqualError(t, err, `Index not defined, add ".indexOn": "text", for path "/messages", to the rules`)
+}
+
+func TestStripComments(t *testing.T) {
+	for _, test := range []struct {
+		src, expected string
+	}{
+		{`{"a": 1} // trailing`, `{"a": 1}            `},
+		{"{\n// line\n\"a\": 1}", "{\n       \n\"a\": 1}"},
+		{"{/* block\n */\"a\": 1}", "{        \n   \"a\": 1}"},
+		{`{"a": "// not a comment"}`, `{"a": "// not a comment"}`},
+		{`{"a": "\"/* still not */"}`, `{"a": "\"/* still not */"}`},
+		{`{"a": 1} /* unterminated`, `{"a": 1}                `},
+	} {
+		assert.Equal(t, test.expected, string(stripComments([]byte(test.src))), test.src)
+	}
+}
+
+func TestRulesCanRead(t *testing.T) {
+	r, err := parseRules([]byte(testRules))
+	require.NoError(t, err)
+
+	alice := map[string]interface{}{"uid": "alice"}
+	admin := map[string]interface{}{"uid": "root", "admin": true}
+	for _, test := range []struct {
+		name    string
+		auth    interface{}
+		path    string
+		allowed bool
+	}{
+		{"anonymous root", nil, "", false},
+		{"admin root", admin, "", true},
+		{"admin cascades", admin, "users/alice/name", true},
+		{"anonymous public", nil, "public", true},
+		{"public cascades", nil, "public/some/deep/path", true},
+		{"own user", alice, "users/alice", true},
+		{"own user child", alice, "users/alice/name", true},
+		{"other user", alice, "users/bob", false},
+		{"parent of own user", alice, "users", false},
+		{"no rules", alice, "messages/1", false},
+	} {
+		env := &ruleEnv{auth: test.auth, root: newNode(nil)}
+		assert.Equal(t, test.allowed, r.canRead(env, test.path), test.name)
+	}
+}
+
+func TestRulesCanWrite(t *testing.T) {
+	r, err := parseRules([]byte(testRules))
+	require.NoError(t, err)
+
+	root := newNode(map[string]interface{}{
+		"users": map[string]interface{}{
+			"alice": map[string]interface{}{"name": "Alice", "age": 30},
+		},
+		"messages": map[string]interface{}{
+			"existing": map[string]interface{}{"author": "alice"},
+		},
+	})
+
+	alice := map[string]interface{}{"uid": "alice"}
+	for _, test := range []struct {
+		name    string
+		auth    interface{}
+		path    string
+		value   interface{}
+		allowed bool
+	}{
+		{"own user", alice, "users/alice", map[string]interface{}{"name": "Al", "age": 3}, true},
+		{"other user", alice, "users/bob", map[string]interface{}{"name": "Bob"}, false},
+		{"anonymous", nil, "users/alice", map[string]interface{}{"name": "Al"}, false},
+		{"public", alice, "public/foo", "bar", false},
+		{"missing required child", alice, "users/alice", map[string]interface{}{"age": 3}, false},
+		{"invalid child", alice, "users/alice", map[string]interface{}{"name": "Alexandria Ocasio"}, false},
+		{"invalid child type", alice, "users/alice", map[string]interface{}{"name": "Al", "age": "3"}, false},
+		{"unknown child", alice, "users/alice", map[string]interface{}{"name": "Al", "foo": 1}, false},
+		{"write child validates parent", alice, "users/alice/age", 3, true},
+		{"write child validates itself", alice, "users/alice/name", 3, false},
+		{"delete validates remaining parent", alice, "users/alice/name", nil, false},
+		{"delete skips validation", alice, "users/alice/age", nil, true},
+		{"delete whole user", alice, "users/alice", nil, true},
+		{"new message", alice, "messages/new", map[string]interface{}{"author": "alice", "createdAt": 1000}, true},
+		{"message in the future", alice, "messages/new", map[string]interface{}{"author": "alice", "createdAt": 3000}, false},
+		{"message from someone else", alice, "messages/new", map[string]interface{}{"author": "bob"}, false},
+		{"overwrite message", alice, "messages/existing", map[string]interface{}{"author": "alice"}, false},
+	} {
+		n := newNode(test.value)
+		env := &ruleEnv{
+			auth:    test.auth,
+			now:     2000,
+			root:    root,
+			newRoot: applyWrite(root, test.path, func(*node) *node { return n }),
+		}
+		assert.Equal(t, test.allowed, r.write(env, test.path).allowed, test.name)
+	}
+}
+
+func TestApplyWrite(t *testing.T) {
+	root := newNode(map[string]interface{}{
+		"foo": map[string]interface{}{"bar": 1, "baz": 2},
+		"qux": "quux",
+	})
+
+	newRoot := applyWrite(root, "foo/bar", func(old *node) *node {
+		assert.Equal(t, json.Number("1"), old.value)
+		return newNode(3)
+	})
+	assert.Equal(t, map[string]interface{}{
+		"foo": map[string]interface{}{"bar": json.Number("3"), "baz": json.Number("2")},
+		"qux": "quux",
+	}, newRoot.objectify())
+	assert.Equal(t, json.Number("1"), root.child("foo/bar").value, "original tree should be untouched")
+
+	newRoot = applyWrite(root, "qux/deep", func(*node) *node { return newNode(true) })
+	assert.Equal(t, map[string]interface{}{"deep": true}, newRoot.child("qux").objectify())
+	assert.Equal(t, "quux", root.child("qux").value)
+
+	newRoot = applyWrite(root, "foo", func(*node) *node { return nil })
+	assert.Equal(t, map[string]interface{}{"qux": "quux"}, newRoot.objectify())
+
+	newRoot = applyWrite(root, "", func(*node) *node { return nil })
+	assert.Nil(t, newRoot.objectify())
+
+	newRoot = applyWrite(newNode(map[string]interface{}{"a": map[string]interface{}{"b": map[string]interface{}{"c": 1}}, "d": 2}),
+		"a/b/c", func(*node) *node { return newNode(map[string]interface{}{}) })
+	assert.Equal(t, map[string]interface{}{"d": json.Number("2")}, newRoot.objectify(), "empty ancestors should be removed")
+	assert.Nil(t, newRoot.children["a"], "empty ancestors should be removed")
+
+	newRoot = applyWrite(root, "qux/deep", func(*node) *node { return nil })
+	assert.Equal(t, "quux", newRoot.child("qux").value, "deleting below a value should keep it")
+}
+
+func TestRulesDeleteLastChild(t *testing.T) {
+	r, err := parseRules([]byte(`{"rules": {
+		"a": {
+			".write": "!newData.exists()",
+			".validate": "newData.hasChildren()"
+		}
+	}}`))
+	require.NoError(t, err)
+
+	root := newNode(map[string]interface{}{"a": map[string]interface{}{"b": 1}})
+	for _, path := range []string{"a/b", "a"} {
+		env := &ruleEnv{root: root}
+		d := r.writeAt(env, path, func(*node) *node { return nil })
+		assert.True(t, d.allowed, path)
+		assert.Nil(t, env.newRoot.child("a"), path)
+	}
+}
@@ -9,11 +9,14 @@ import (
 	"crypto/sha256"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io/ioutil"
 	"log"
 	"net"
 	"net/http"
 	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
 )
@@ -23,8 +26,24 @@ var (
 	missingBody          = []byte(`{"error":"Error: No data supplied."}`)
 	invalidJSON          = []byte(`{"error":"Invalid data; couldn't parse JSON object, array, or value. Perhaps you're using invalid characters in your key names."}`)
 	invalidAuth          = []byte(`{"error" : "Could not parse auth token."}`)
+	permissionDenied     = []byte(`{"error" : "Permission denied"}`)
+	rulesSaved           = []byte(`{"status" : "ok"}`)
+	defaultRules         = []byte(`{"rules":{".read":true,".write":true}}`)
+	authRevoked          = []byte(`"credential is no longer valid"`)
 )
 
+var (
+	errPermissionDenied = errors.New("Permission denied")
+	errETagMismatch     = errors.New("ETag does not match")
+)
+
+// rulesPath is the location used to read and write the security rules
+const rulesPath = ".settings/rules"
+
+// etagRequestHeader is set to true on requests that want the
+// ETag of the data in the response
+const etagRequestHeader = "X-Firebase-ETag"
+
 // Firetest is a Firebase server implementation
 type Firetest struct {
 	// URL of form http://ipaddr:port with no trailing slash
@@ -36,6 +55,13 @@ type Firetest struct {
 	db       *treeDB
 
 	requireAuth *int32
+	pushIDs     *pushIDGenerator
+
+	rulesMtx sync.RWMutex
+	rules    *rules
+
+	limitsMtx sync.RWMutex
+	limits    Limits
 }
 
 // New creates a new Firetest server
@@ -44,6 +70,8 @@ func New() *Firetest {
 		db:          newTree(),
 		Secret:      base64.URLEncoding.EncodeToString([]byte(fmt.Sprint(time.Now().UnixNano()))),
 		requireAuth: new(int32),
+		pushIDs:     newPushIDGenerator(time.Now().UnixNano()),
+		limits:      DefaultLimits,
 	}
 }
 
@@ -84,23 +112,33 @@ func (ft *Firetest) serveHTTP(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	if atomic.LoadInt32(ft.requireAuth) == 1 {
-		var authenticated bool
-		authHeader := req.URL.Query().Get("auth")
-		switch {
-		case strings.Contains(authHeader, "."):
-			authenticated = ft.validJWT(authHeader)
-		default:
-			authenticated = authHeader == ft.Secret
-		}
-
-		if !authenticated {
+	creds, authenticated := ft.authenticate(req)
+	if !authenticated {
+		hasToken := req.URL.Query().Get("auth") != ""
+		if atomic.LoadInt32(ft.requireAuth) == 1 || (hasToken && ft.getRules() != nil) {
 			w.WriteHeader(http.StatusUnauthorized)
 			w.Write(invalidAuth)
 			return
 		}
 	}
 
+	if _, err := parsePrint(req.URL.Query()); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	if sanitizePath(req.URL.Path) == rulesPath {
+		ft.settings(w, req, creds)
+		return
+	}
+
+	// the path has already been unescaped, so keys
+	// can be written with percent-encoded characters
+	if _, err := ft.validPath(req.URL.Path); err != nil {
+		writeError(w, http.StatusBadRequest, errInvalidPath)
+		return
+	}
+
 	switch req.Method {
 	case "PUT":
 		ft.set(w, req)
@@ -123,6 +161,44 @@ func (ft *Firetest) serveHTTP(w http.ResponseWriter, req *http.Request) {
 	}
 }
 
+// writeJSON encodes v as the response body, formatting it
+// according to the print query parameter.
+//
+// Reference https://www.firebase.com/docs/rest/api/#section-param-print
+func writeJSON(w http.ResponseWriter, req *http.Request, v interface{}) {
+	var (
+		b   []byte
+		err error
+	)
+
+	// marshal objects with their keys in the order of Firebase
+	v = ordered(v)
+
+	mode, _ := parsePrint(req.URL.Query())
+	switch mode {
+	case printSilent:
+		w.WriteHeader(http.StatusNoContent)
+		return
+	case printPretty:
+		b, err = json.MarshalIndent(v, "", "  ")
+	default:
+		b, err = json.Marshal(v)
+	}
+
+	if err != nil {
+		log.Printf("Error encoding json: %s", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Write(b)
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	msg, _ := json.Marshal(err.Error())
+	w.WriteHeader(status)
+	fmt.Fprintf(w, `{"error" : %s}`, msg)
+}
+
 func decodeSegment(seg string) ([]byte, error) {
 	if l := len(seg) % 4; l > 0 {
 		seg += strings.Repeat("=", 4-l)
@@ -131,66 +207,105 @@ func decodeSegment(seg string) ([]byte, error) {
 	return base64.URLEncoding.DecodeString(seg)
 }
 
-func (ft *Firetest) validJWT(val string) bool {
+// credentials identifies the sender of a request
+type credentials struct {
+	// admin is set for requests authenticated with the
+	// secret or an admin token, which bypass the rules
+	admin bool
+
+	// auth is the value of the auth rules variable
+	auth interface{}
+
+	// expires is when the token expires, if it does
+	expires time.Time
+}
+
+// authenticate reads the credentials from the auth query parameter.
+// It reports false if the request is not properly authenticated.
+func (ft *Firetest) authenticate(req *http.Request) (credentials, bool) {
+	token := req.URL.Query().Get("auth")
+	switch {
+	case token == "":
+		return credentials{}, false
+	case strings.Contains(token, "."):
+		claims, ok := ft.parseJWT(token)
+		if !ok {
+			return credentials{}, false
+		}
+
+		creds := credentials{auth: claims["d"]}
+		creds.admin, _ = claims["admin"].(bool)
+		if exp, ok := claims["exp"].(float64); ok {
+			creds.expires = time.Unix(int64(exp), 0)
+		}
+		return creds, true
+	case token == ft.Secret:
+		return credentials{admin: true}, true
+	}
+	return credentials{}, false
+}
+
+// parseJWT validates the token and returns its claims
+func (ft *Firetest) parseJWT(val string) (map[string]interface{}, bool) {
 	parts := strings.Split(val, ".")
 	if len(parts) != 3 {
-		return false
+		return nil, false
 	}
 
 	// validate header
 	hb, err := decodeSegment(parts[0])
 	if err != nil {
 		log.Println("error decoding header", err)
-		return false
+		return nil, false
 	}
 	var header map[string]string
 	if err := json.Unmarshal(hb, &header); err != nil {
 		log.Println("error unmarshaling header", err)
-		return false
+		return nil, false
 	}
 	if header["alg"] != "HS256" || header["typ"] != "JWT" {
-		return false
+		return nil, false
 	}
 
 	// validate claim
 	cb, err := decodeSegment(parts[1])
 	if err != nil {
 		log.Println("error decoding claim", err)
-		return false
+		return nil, false
 	}
 	var claim map[string]interface{}
 	if err := json.Unmarshal(cb, &claim); err != nil {
 		log.Println("error unmarshaling claim", err)
-		return false
+		return nil, false
 	}
 	if e, ok := claim["exp"]; ok {
 		// make sure not expired
 		exp, ok := e.(float64)
 		if !ok {
 			log.Println("expiration not a number")
-			return false
+			return nil, false
 		}
 		if int64(exp) < time.Now().Unix() {
 			log.Println("token expired")
-			return false
+			return nil, false
 		}
 	}
 	// ensure uid present
 	data, ok := claim["d"]
 	if !ok {
 		log.Println("missing data in claim")
-		return false
+		return nil, false
 	}
 
 	d, ok := data.(map[string]interface{})
 	if !ok {
 		log.Println("claim['data'] is not map")
-		return false
+		return nil, false
 	}
 
 	if _, ok := d["uid"]; !ok {
 		log.Println("claim['data'] missing uid")
-		return false
+		return nil, false
 	}
 
 	if sig, err := decodeSegment(parts[2]); err == nil {
@@ -200,60 +315,306 @@ func (ft *Firetest) validJWT(val string) bool {
 
 		if !hmac.Equal(sig, hasher.Sum(nil)) {
 			log.Println("invalid jwt signature")
-			return false
+			return nil, false
+		}
+	}
+
+	return claim, true
+}
+
+func (ft *Firetest) getLimits() Limits {
+	ft.limitsMtx.RLock()
+	defer ft.limitsMtx.RUnlock()
+	return ft.limits
+}
+
+func (ft *Firetest) getRules() *rules {
+	ft.rulesMtx.RLock()
+	defer ft.rulesMtx.RUnlock()
+	return ft.rules
+}
+
+// settings reads and writes the security rules. Only admins
+// can access them once rules or authentication are required.
+//
+// Reference https://www.firebase.com/docs/rest/api/#section-security-rules
+func (ft *Firetest) settings(w http.ResponseWriter, req *http.Request, creds credentials) {
+	r := ft.getRules()
+	if !creds.admin && (r != nil || atomic.LoadInt32(ft.requireAuth) == 1) {
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write(permissionDenied)
+		return
+	}
+
+	switch req.Method {
+	case "GET":
+		w.Header().Add("Content-Type", "application/json")
+		if r == nil {
+			w.Write(defaultRules)
+			return
+		}
+		w.Write(r.source)
+	case "PUT":
+		body, err := ioutil.ReadAll(req.Body)
+		if err != nil || len(body) == 0 {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write(missingBody)
+			return
+		}
+
+		if err := ft.SetRules(body); err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("Error saving rules - %v", err))
+			return
+		}
+		w.Write(rulesSaved)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// canRead checks the security rules for reading path. They are
+// evaluated against the data in the tree, which is not copied.
+func (ft *Firetest) canRead(creds credentials, path string) bool {
+	if ft.getRules() == nil || creds.admin {
+		return true
+	}
+
+	var allowed bool
+	ft.db.view(func(root *node, now time.Time) {
+		allowed = ft.canReadIn(creds, path, root, now)
+	})
+	return allowed
+}
+
+// canReadIn is canRead with the rules evaluated against
+// root at the given time instead of the data in the tree
+func (ft *Firetest) canReadIn(creds credentials, path string, root *node, now time.Time) bool {
+	r := ft.getRules()
+	if r == nil || creds.admin {
+		return true
+	}
+	return r.canRead(&ruleEnv{auth: creds.auth, now: millis(now), root: root}, path)
+}
+
+// authorizeRead checks the security rules before reading path,
+// responding with an error if the read is not permitted.
+func (ft *Firetest) authorizeRead(w http.ResponseWriter, req *http.Request, path string) bool {
+	creds, _ := ft.authenticate(req)
+	if ft.canRead(creds, path) {
+		return true
+	}
+
+	w.WriteHeader(http.StatusUnauthorized)
+	w.Write(permissionDenied)
+	return false
+}
+
+// indexed checks that the rules, if any, define the index needed
+// by q, responding with an error if they do not
+func (ft *Firetest) indexed(w http.ResponseWriter, path string, q *query) bool {
+	r := ft.getRules()
+	if r == nil {
+		return true
+	}
+
+	if err := r.checkIndex(path, q); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return false
+	}
+	return true
+}
+
+// writeCheck returns the check made before a write is applied on
+// behalf of req, which fails with errPermissionDenied if the security
+// rules do not permit it. It is nil if the rules do not apply.
+func (ft *Firetest) writeCheck(req *http.Request) writeCheck {
+	r := ft.getRules()
+	creds, _ := ft.authenticate(req)
+	if r == nil || creds.admin {
+		return nil
+	}
+
+	return func(w write) error {
+		env := &ruleEnv{auth: creds.auth, now: millis(w.now), root: w.root}
+		if !r.writeAt(env, w.path, w.change, w.locations...).allowed {
+			return errPermissionDenied
 		}
+		return nil
 	}
+}
 
+// ifMatch returns a check that fails with errETagMismatch if the ETag
+// of the data at the location written does not match etag, and that
+// otherwise makes the given check, if any
+func ifMatch(etag string, check writeCheck) writeCheck {
+	return func(w write) error {
+		if w.root.child(w.path).etag() != etag {
+			return errETagMismatch
+		}
+		if check == nil {
+			return nil
+		}
+		return check(w)
+	}
+}
+
+// writeFailed responds with the error returned by
+// a write and reports whether there was one
+func (ft *Firetest) writeFailed(w http.ResponseWriter, err error) bool {
+	switch err {
+	case nil:
+		return false
+	case errPermissionDenied:
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write(permissionDenied)
+	default:
+		writeError(w, http.StatusBadRequest, ft.getLimits().restError(err))
+	}
 	return true
 }
 
 func (ft *Firetest) set(w http.ResponseWriter, req *http.Request) {
-	body, v, ok := unmarshal(w, req.Body)
+	_, v, ok := unmarshal(w, req.Body, ft.getLimits().MaxWriteSize)
 	if !ok {
 		return
 	}
 
-	ft.Set(req.URL.Path, v)
-	w.Write(body)
+	stored, ok := ft.setIfMatch(w, req, v)
+	if !ok {
+		return
+	}
+	if req.Header.Get(etagRequestHeader) == "true" {
+		path, _ := priorityPath(sanitizePath(req.URL.Path))
+		w.Header().Set("ETag", ft.db.get(path).etag())
+	}
+	writeJSON(w, req, stored)
+}
+
+// setIfMatch sets v at the requested location, deleting the data there
+// if v is nil, if the security rules permit it, and returns the data
+// stored. If the request has an if-match header, v is only set if the
+// header matches the ETag of the current data. Otherwise it responds
+// with the current data and its ETag.
+//
+// Reference https://www.firebase.com/docs/rest/api/#section-conditional-requests
+func (ft *Firetest) setIfMatch(w http.ResponseWriter, req *http.Request, v interface{}) (interface{}, bool) {
+	path := sanitizePath(req.URL.Path)
+	check := ft.writeCheck(req)
+	etag := req.Header.Get("if-match")
+	if _, ok := priorityPath(path); !ok && etag != "" {
+		check = ifMatch(etag, check)
+	}
+
+	stored, err := ft.setIf(path, v, check)
+	if err == errETagMismatch {
+		current := ft.db.get(path)
+		w.Header().Set("ETag", current.etag())
+		w.WriteHeader(http.StatusPreconditionFailed)
+		b, _ := json.Marshal(current)
+		w.Write(b)
+		return nil, false
+	}
+	return stored, !ft.writeFailed(w, err)
 }
 
 func (ft *Firetest) update(w http.ResponseWriter, req *http.Request) {
-	body, v, ok := unmarshal(w, req.Body)
+	_, v, ok := unmarshal(w, req.Body, ft.getLimits().MaxWriteSize)
 	if !ok {
 		return
 	}
-	ft.Update(req.URL.Path, v)
-	w.Write(body)
+
+	stored, err := ft.updateIf(req.URL.Path, v, ft.writeCheck(req))
+	if ft.writeFailed(w, err) {
+		return
+	}
+	writeJSON(w, req, stored)
 }
 
 func (ft *Firetest) create(w http.ResponseWriter, req *http.Request) {
-	_, v, ok := unmarshal(w, req.Body)
+	_, v, ok := unmarshal(w, req.Body, ft.getLimits().MaxWriteSize)
 	if !ok {
 		return
 	}
 
-	name := ft.Create(req.URL.Path, v)
-	rtn := map[string]string{"name": name}
-	if err := json.NewEncoder(w).Encode(rtn); err != nil {
-		log.Printf("Error encoding json: %s", err)
-		w.WriteHeader(http.StatusInternalServerError)
+	if _, ok := priorityPath(sanitizePath(req.URL.Path)); ok {
+		writeError(w, http.StatusBadRequest, errInvalidPath)
+		return
 	}
+
+	name, err := ft.createIf(sanitizePath(req.URL.Path), v, ft.writeCheck(req))
+	if ft.writeFailed(w, err) {
+		return
+	}
+	writeJSON(w, req, map[string]string{"name": name})
 }
 
 func (ft *Firetest) del(w http.ResponseWriter, req *http.Request) {
-	ft.Delete(req.URL.Path)
+	if _, ok := ft.setIfMatch(w, req, nil); !ok {
+		return
+	}
+	writeJSON(w, req, nil)
 }
 
 func (ft *Firetest) get(w http.ResponseWriter, req *http.Request) {
 	w.Header().Add("Content-Type", "application/json")
 
-	v := ft.Get(req.URL.Path)
-	if err := json.NewEncoder(w).Encode(v); err != nil {
-		log.Printf("Error encoding json: %s", err)
-		w.WriteHeader(http.StatusInternalServerError)
+	params := req.URL.Query()
+	shallow, err := parseShallow(params)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
 	}
+	export, err := parseFormat(params)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	q, err := parseQuery(params)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	path := sanitizePath(req.URL.Path)
+	if !ft.indexed(w, path, q) {
+		return
+	}
+	if p, ok := priorityPath(path); ok {
+		if ft.authorizeRead(w, req, p) {
+			writeJSON(w, req, ft.Get(path))
+		}
+		return
+	}
+	if !ft.authorizeRead(w, req, path) {
+		return
+	}
+
+	n := ft.db.get(path)
+	if req.Header.Get(etagRequestHeader) == "true" {
+		w.Header().Set("ETag", n.etag())
+	}
+	if q != nil {
+		n = q.apply(n)
+	}
+
+	var v interface{}
+	switch {
+	case shallow:
+		v = n.shallow()
+	case export:
+		v = n.export()
+	default:
+		v = n.objectify()
+	}
+	writeJSON(w, req, v)
 }
 
+// sse streams the changes made at the requested location, limited
+// to the result of the query if query parameters are given. The
+// stream is cancelled once the data can no longer be read and
+// ends with auth_revoked once the auth token expires.
+//
+// Reference https://www.firebase.com/docs/rest/api/#section-streaming
 func (ft *Firetest) sse(w http.ResponseWriter, req *http.Request) {
 	f, ok := w.(http.Flusher)
 	if !ok {
@@ -263,11 +624,50 @@ func (ft *Firetest) sse(w http.ResponseWriter, req *http.Request) {
 
 	w.Header().Set("Content-Type", "text/event-stream")
 
+	q, err := parseQuery(req.URL.Query())
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
 	path := sanitizePath(req.URL.Path)
-	c := ft.db.watch(path)
+	if !ft.indexed(w, path, q) {
+		return
+	}
+	if !ft.authorizeRead(w, req, path) {
+		return
+	}
+	creds, _ := ft.authenticate(req)
+
+	var expired <-chan time.Time
+	if !creds.expires.IsZero() {
+		timer := time.NewTimer(creds.expires.Sub(time.Now()))
+		defer timer.Stop()
+		expired = timer.C
+	}
+
+	// any write can change what the rules allow, so the stream
+	// receives every write and keeps its own copy of the tree to
+	// check them against, rather than locking the tree for each
+	var (
+		c          chan event
+		root, data *node
+		rules      = !creds.admin && ft.getRules() != nil
+	)
+	if rules {
+		c, root = ft.db.watchTree(path)
+		data = root.child(path)
+	} else {
+		c, data = ft.db.watchData(path)
+	}
 	defer ft.db.stopWatching(path, c)
 
-	d := eventData{Path: path, Data: ft.db.get(path)}
+	d := eventData{Data: data}
+	var lq *liveQuery
+	if q != nil {
+		lq = newLiveQuery(q, d.Data)
+		d.Data = lq.view
+	}
 	s, err := json.Marshal(d)
 	if err != nil {
 		fmt.Printf("Error marshaling node %s\n", err)
@@ -284,12 +684,48 @@ func (ft *Firetest) sse(w http.ResponseWriter, req *http.Request) {
 			fmt.Fprintf(w, "event: keep-alive\ndata: null")
 			f.Flush()
 			continue
+		case <-expired:
+			fmt.Fprintf(w, "event: auth_revoked\ndata: %s\n\n", authRevoked)
+			f.Flush()
+			return
 		case n, ok := <-c:
 			if !ok {
 				return
 			}
 
-			s, err := json.Marshal(n.Data)
+			switch n.Name {
+			case eventAuthRevoked:
+				fmt.Fprintf(w, "event: auth_revoked\ndata: %s\n\n", authRevoked)
+				f.Flush()
+				return
+			case eventCancel:
+				fmt.Fprintf(w, "event: cancel\ndata: null\n\n")
+				f.Flush()
+				return
+			}
+
+			if rules {
+				root = n.apply(root)
+				if !ft.canReadIn(creds, path, root, n.now) {
+					fmt.Fprintf(w, "event: cancel\ndata: null\n\n")
+					f.Flush()
+					return
+				}
+				if n, ok = n.relativeTo(path); !ok {
+					continue
+				}
+			}
+
+			if lq != nil {
+				// only send the changes to the query result, which
+				// is kept up to date with the data each event carries
+				data = n.apply(data)
+				if n, ok = lq.update(data); !ok {
+					continue
+				}
+			}
+
+			s, err := json.Marshal(streamData(n))
 			if err != nil {
 				fmt.Printf("Error marshaling node %s\n", err)
 				continue
@@ -300,3 +736,21 @@ func (ft *Firetest) sse(w http.ResponseWriter, req *http.Request) {
 		}
 	}
 }
+
+// streamData returns the data sent on a stream for e. The data of a
+// patch is always an object of the locations it writes, even when
+// they are all integers and would otherwise be read as an array.
+func streamData(e event) interface{} {
+	if e.Name != eventPatch || e.Data.Data == nil {
+		return e.Data
+	}
+
+	data := make(orderedObject, len(e.Data.Data.children))
+	for k, child := range e.Data.Data.children {
+		data[k] = child
+	}
+	return struct {
+		Path string        `json:"path"`
+		Data orderedObject `json:"data"`
+	}{"/" + e.Data.Path, data}
+}
@@ -1,7 +1,11 @@
 package firetest
 
 import (
+	"bufio"
 	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
@@ -10,7 +14,10 @@ import (
 	"net/url"
 	"regexp"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -99,7 +106,8 @@ func TestValidJWT(t *testing.T) {
 	} {
 		ft := New()
 		ft.Secret = "foo"
-		assert.Equal(t, test.pass, ft.validJWT(test.jwtToken), test.name)
+		_, ok := ft.parseJWT(test.jwtToken)
+		assert.Equal(t, test.pass, ok, test.name)
 	}
 }
 
@@ -288,7 +296,7 @@ func TestServerDel(t *testing.T) {
 	ft.Start()
 	path := "foo/bar"
 	n := newNode(2)
-	ft.db.add(path, n)
+	ft.db.addIf(path, n, nil)
 
 	// ACT
 	req, err := http.NewRequest("DELETE", ft.URL+"/"+path+".json", nil)
@@ -314,11 +322,11 @@ func TestServerUpdate(t *testing.T) {
 		"fooy": true,
 		"bar":  []interface{}{false, "lolz"},
 	}
-	ft.db.add(path, newNode(body))
+	ft.db.addIf(path, newNode(body), nil)
 
 	// ACT
-	newVal := `"notbar"`
-	req, err := http.NewRequest("PATCH", ft.URL+"/some/awesome/path/foo.json", strings.NewReader(newVal))
+	newVal := `{"foo":"notbar"}`
+	req, err := http.NewRequest("PATCH", ft.URL+"/some/awesome/path.json", strings.NewReader(newVal))
 	require.NoError(t, err)
 	resp := httptest.NewRecorder()
 	ft.serveHTTP(resp, req)
@@ -328,6 +336,107 @@ func TestServerUpdate(t *testing.T) {
 	respBody, err := ioutil.ReadAll(resp.Body)
 	require.NoError(t, err)
 	assert.Equal(t, newVal, string(respBody))
+	assert.Equal(t, true, ft.Get(path+"/fooy"), "children not in the update should be kept")
+}
+
+func TestServerUpdatePaths(t *testing.T) {
+	// ARRANGE
+	ft := New()
+	ft.Start()
+	ft.Set("users/alice", map[string]interface{}{"name": "Alice", "age": 30})
+
+	for _, test := range []struct {
+		body   string
+		status int
+		value  interface{}
+	}{
+		{`{"alice/name": "Alicia", "bob/name": "Bob"}`, http.StatusOK, map[string]interface{}{
+			"alice": map[string]interface{}{"name": "Alicia", "age": 30.0},
+			"bob":   map[string]interface{}{"name": "Bob"},
+		}},
+		{`{"alice": null, "alice/age": 31}`, http.StatusBadRequest, map[string]interface{}{
+			"alice": map[string]interface{}{"name": "Alicia", "age": 30.0},
+			"bob":   map[string]interface{}{"name": "Bob"},
+		}},
+		{`{"alice/age": null, "bob": null}`, http.StatusOK, map[string]interface{}{
+			"alice": map[string]interface{}{"name": "Alicia"},
+		}},
+	} {
+		// ACT
+		req, err := http.NewRequest("PATCH", ft.URL+"/users.json", strings.NewReader(test.body))
+		require.NoError(t, err)
+		resp := httptest.NewRecorder()
+		ft.serveHTTP(resp, req)
+
+		// ASSERT
+		assert.Equal(t, test.status, resp.Code, test.body)
+		b, err := json.Marshal(ft.Get("users"))
+		require.NoError(t, err)
+		expected, err := json.Marshal(test.value)
+		require.NoError(t, err)
+		assert.Equal(t, string(expected), string(b), test.body)
+	}
+}
+
+func TestServerNumbers(t *testing.T) {
+	// ARRANGE
+	ft := New()
+	ft.Start()
+	ft.Set("numbers/direct", 3.0)
+
+	// ACT
+	body := `{"big":9007199254740993,"decimal":2.50,"integral":3.0,"zero":-0}`
+	req, err := http.NewRequest("PATCH", ft.URL+"/numbers.json", strings.NewReader(body))
+	require.NoError(t, err)
+	ft.serveHTTP(httptest.NewRecorder(), req)
+
+	req, err = http.NewRequest("GET", ft.URL+"/numbers.json", nil)
+	require.NoError(t, err)
+	resp := httptest.NewRecorder()
+	ft.serveHTTP(resp, req)
+
+	// ASSERT
+	assert.Equal(t, http.StatusOK, resp.Code)
+	assert.Equal(t, `{"big":9007199254740993,"decimal":2.5,"direct":3,"integral":3,"zero":0}`, resp.Body.String())
+	assert.Equal(t, ft.Get("numbers/direct"), ft.Get("numbers/integral"), "numbers should not depend on how they were written")
+
+	req, err = http.NewRequest("GET", ft.URL+`/numbers.json?orderBy="$value"&startAt=9007199254740993`, nil)
+	require.NoError(t, err)
+	resp = httptest.NewRecorder()
+	ft.serveHTTP(resp, req)
+	assert.Equal(t, `{"big":9007199254740993}`, resp.Body.String())
+}
+
+func TestServerLargeNumbers(t *testing.T) {
+	// ARRANGE
+	ft := New()
+	ft.Start()
+	ft.Set("numbers/small", 1)
+
+	// ACT
+	req, err := http.NewRequest("PUT", ft.URL+"/numbers/huge.json", strings.NewReader("1e400"))
+	require.NoError(t, err)
+	resp := httptest.NewRecorder()
+	ft.serveHTTP(resp, req)
+
+	// ASSERT
+	assert.Equal(t, http.StatusOK, resp.Code)
+	assert.Equal(t, "1e400", resp.Body.String())
+	assert.Equal(t, json.Number("1e400"), ft.Get("numbers/huge"))
+
+	req, err = http.NewRequest("GET", ft.URL+`/numbers.json?orderBy="$value"&startAt=1e400`, nil)
+	require.NoError(t, err)
+	resp = httptest.NewRecorder()
+	ft.serveHTTP(resp, req)
+	assert.Equal(t, http.StatusOK, resp.Code)
+	assert.Equal(t, `{"huge":1e400}`, resp.Body.String())
+
+	req, err = http.NewRequest("GET", ft.URL+`/numbers.json?orderBy="$value"&endAt=-1e400`, nil)
+	require.NoError(t, err)
+	resp = httptest.NewRecorder()
+	ft.serveHTTP(resp, req)
+	assert.Equal(t, http.StatusOK, resp.Code)
+	assert.Equal(t, "null", resp.Body.String())
 }
 
 func TestServerGet(t *testing.T) {
@@ -341,7 +450,7 @@ func TestServerGet(t *testing.T) {
 		"fooy": true,
 		"bar":  []interface{}{false, "lolz"},
 	}
-	ft.db.add(path, newNode(body))
+	ft.db.addIf(path, newNode(body), nil)
 
 	b, err := json.Marshal(&body)
 	require.NoError(t, err)
@@ -359,3 +468,997 @@ func TestServerGet(t *testing.T) {
 
 	assert.EqualValues(t, body, respBody)
 }
+
+func TestServerGetQuery(t *testing.T) {
+	// ARRANGE
+	ft := New()
+	ft.Start()
+
+	ft.db.addIf("scores", newNode(map[string]interface{}{
+		"alice": 10,
+		"bob":   30,
+		"carol": 20,
+	}), nil)
+
+	// ACT
+	req, err := http.NewRequest("GET", ft.URL+`/scores.json?orderBy="$value"&limitToLast=2`, nil)
+	require.NoError(t, err)
+	resp := httptest.NewRecorder()
+	ft.serveHTTP(resp, req)
+
+	// ASSERT
+	assert.Equal(t, http.StatusOK, resp.Code)
+	var respBody map[string]interface{}
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&respBody))
+	assert.Equal(t, map[string]interface{}{"bob": 30.0, "carol": 20.0}, respBody)
+}
+
+func TestServerGetInvalidQuery(t *testing.T) {
+	// ARRANGE
+	ft := New()
+	ft.Start()
+
+	// ACT
+	req, err := http.NewRequest("GET", ft.URL+"/scores.json?limitToLast=2", nil)
+	require.NoError(t, err)
+	resp := httptest.NewRecorder()
+	ft.serveHTTP(resp, req)
+
+	// ASSERT
+	assert.Equal(t, http.StatusBadRequest, resp.Code)
+	assert.Equal(t, `{"error" : "orderBy must be defined when other query parameters are defined"}`, resp.Body.String())
+}
+
+func TestServerGetShallow(t *testing.T) {
+	// ARRANGE
+	ft := New()
+	ft.Start()
+
+	ft.db.addIf("foo", newNode(map[string]interface{}{
+		"bar": map[string]interface{}{"baz": true},
+		"qux": "quux",
+	}), nil)
+
+	// ACT
+	req, err := http.NewRequest("GET", ft.URL+"/foo.json?shallow=true", nil)
+	require.NoError(t, err)
+	resp := httptest.NewRecorder()
+	ft.serveHTTP(resp, req)
+
+	// ASSERT
+	assert.Equal(t, http.StatusOK, resp.Code)
+	var respBody map[string]interface{}
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&respBody))
+	assert.Equal(t, map[string]interface{}{"bar": true, "qux": "quux"}, respBody)
+}
+
+func TestServerPrintSilent(t *testing.T) {
+	// ARRANGE
+	ft := New()
+	ft.Start()
+
+	for _, method := range []string{"GET", "PATCH", "POST", "PUT", "DELETE"} {
+		// ACT
+		req, err := http.NewRequest(method, ft.URL+"/foo.json?print=silent", strings.NewReader(`{"bar":true}`))
+		require.NoError(t, err)
+		resp := httptest.NewRecorder()
+		ft.serveHTTP(resp, req)
+
+		// ASSERT
+		assert.Equal(t, http.StatusNoContent, resp.Code, method)
+		assert.Empty(t, resp.Body.Bytes(), method)
+	}
+}
+
+func TestServerPrintPretty(t *testing.T) {
+	// ARRANGE
+	ft := New()
+	ft.Start()
+
+	// ACT
+	req, err := http.NewRequest("PUT", ft.URL+"/foo.json?print=pretty", strings.NewReader(`{"bar":{"baz":true}}`))
+	require.NoError(t, err)
+	resp := httptest.NewRecorder()
+	ft.serveHTTP(resp, req)
+
+	// ASSERT
+	assert.Equal(t, http.StatusOK, resp.Code)
+	assert.Equal(t, "{\n  \"bar\": {\n    \"baz\": true\n  }\n}", resp.Body.String())
+}
+
+func TestServerInvalidPrint(t *testing.T) {
+	// ARRANGE
+	ft := New()
+	ft.Start()
+
+	// ACT
+	req, err := http.NewRequest("GET", ft.URL+"/foo.json?print=loud", nil)
+	require.NoError(t, err)
+	resp := httptest.NewRecorder()
+	ft.serveHTTP(resp, req)
+
+	// ASSERT
+	assert.Equal(t, http.StatusBadRequest, resp.Code)
+	assert.Equal(t, `{"error" : "print must be either 'pretty' or 'silent'"}`, resp.Body.String())
+}
+
+func TestServerPriority(t *testing.T) {
+	// ARRANGE
+	ft := New()
+	ft.Start()
+	ft.db.addIf("foo", newNode(map[string]interface{}{"bar": true}), nil)
+
+	// ACT
+	req, err := http.NewRequest("PUT", ft.URL+"/foo/.priority.json", strings.NewReader("2"))
+	require.NoError(t, err)
+	resp := httptest.NewRecorder()
+	ft.serveHTTP(resp, req)
+	require.Equal(t, http.StatusOK, resp.Code)
+
+	req, err = http.NewRequest("GET", ft.URL+"/foo/.priority.json", nil)
+	require.NoError(t, err)
+	resp = httptest.NewRecorder()
+	ft.serveHTTP(resp, req)
+
+	// ASSERT
+	assert.Equal(t, http.StatusOK, resp.Code)
+	assert.Equal(t, "2", resp.Body.String())
+}
+
+func TestServerGetExport(t *testing.T) {
+	// ARRANGE
+	ft := New()
+	ft.Start()
+
+	body := `{".priority":"a","bar":{".priority":1,".value":true}}`
+	req, err := http.NewRequest("PUT", ft.URL+"/foo.json", strings.NewReader(body))
+	require.NoError(t, err)
+	ft.serveHTTP(httptest.NewRecorder(), req)
+
+	for _, test := range []struct {
+		params   string
+		expected string
+	}{
+		{"", `{"bar":true}`},
+		{"format=export", body},
+	} {
+		// ACT
+		req, err := http.NewRequest("GET", ft.URL+"/foo.json?"+test.params, nil)
+		require.NoError(t, err)
+		resp := httptest.NewRecorder()
+		ft.serveHTTP(resp, req)
+
+		// ASSERT
+		assert.Equal(t, http.StatusOK, resp.Code, test.params)
+		assert.Equal(t, test.expected, resp.Body.String(), test.params)
+	}
+}
+
+func TestServerCreateServerValues(t *testing.T) {
+	// ARRANGE
+	ft := New()
+	ft.Start()
+	ft.SetClock(func() time.Time { return time.Unix(1437139539, 0) })
+
+	// ACT
+	body := `{"message":"hi","meta":{"createdAt":{".sv":"timestamp"}}}`
+	req, err := http.NewRequest("POST", ft.URL+"/messages.json", strings.NewReader(body))
+	require.NoError(t, err)
+	resp := httptest.NewRecorder()
+	ft.serveHTTP(resp, req)
+
+	// ASSERT
+	require.Equal(t, http.StatusOK, resp.Code)
+	var v map[string]string
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&v))
+	assert.Equal(t, json.Number("1437139539000"), ft.Get("messages/"+v["name"]+"/meta/createdAt"))
+}
+
+func TestServerWriteResponse(t *testing.T) {
+	// ARRANGE
+	ft := New()
+	ft.Start()
+	ft.SetClock(func() time.Time { return time.Unix(1437139539, 0) })
+	ft.Set("foo", map[string]interface{}{"count": 1})
+
+	for _, test := range []struct {
+		method   string
+		path     string
+		body     string
+		expected string
+	}{
+		{"PUT", "/foo/time.json", `{".sv":"timestamp"}`, `1437139539000`},
+		{"PUT", "/foo/meta.json", `{"a":{},"b":{".sv":"timestamp"}}`, `{"b":1437139539000}`},
+		{"PATCH", "/foo.json", `{"count":{".sv":{"increment":2}},"bar/baz":"qux"}`, `{"bar/baz":"qux","count":3}`},
+		{"PUT", "/foo/.priority.json", `2`, `2`},
+		{"PATCH", "/foo.json", `{".priority":7}`, `{".priority":7}`},
+	} {
+		// ACT
+		req, err := http.NewRequest(test.method, ft.URL+test.path, strings.NewReader(test.body))
+		require.NoError(t, err)
+		resp := httptest.NewRecorder()
+		ft.serveHTTP(resp, req)
+
+		// ASSERT
+		assert.Equal(t, http.StatusOK, resp.Code, "%s %s", test.method, test.path)
+		assert.Equal(t, test.expected, resp.Body.String(), "%s %s", test.method, test.path)
+	}
+}
+
+func testJWT(secret string, data map[string]interface{}) string {
+	return testJWTClaims(secret, map[string]interface{}{"v": 0, "d": data, "iat": 1437139539})
+}
+
+func testJWTClaims(secret string, c map[string]interface{}) string {
+	header := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"HS256","typ":"JWT"}`))
+	b, _ := json.Marshal(c)
+	claims := base64.RawURLEncoding.EncodeToString(b)
+
+	hasher := hmac.New(sha256.New, []byte(secret))
+	hasher.Write([]byte(header + "." + claims))
+	return header + "." + claims + "." + base64.RawURLEncoding.EncodeToString(hasher.Sum(nil))
+}
+
+func TestServerRules(t *testing.T) {
+	// ARRANGE
+	ft := New()
+	ft.Start()
+
+	rules := `{"rules": {"users": {"$uid": {".read": "auth.uid === $uid", ".write": "auth.uid === $uid"}}}}`
+	req, err := http.NewRequest("PUT", ft.URL+"/.settings/rules.json", strings.NewReader(rules))
+	require.NoError(t, err)
+	resp := httptest.NewRecorder()
+	ft.serveHTTP(resp, req)
+	require.Equal(t, http.StatusOK, resp.Code)
+	assert.Equal(t, rulesSaved, resp.Body.Bytes())
+
+	alice := testJWT(ft.Secret, map[string]interface{}{"uid": "alice"})
+	for _, test := range []struct {
+		method string
+		path   string
+		auth   string
+		status int
+	}{
+		{"PUT", "/users/alice.json", alice, http.StatusOK},
+		{"PATCH", "/users/alice.json", alice, http.StatusOK},
+		{"POST", "/users/alice.json", alice, http.StatusOK},
+		{"GET", "/users/alice.json", alice, http.StatusOK},
+		{"PUT", "/users/alice/.priority.json", alice, http.StatusOK},
+		{"DELETE", "/users/alice.json", alice, http.StatusOK},
+		{"PUT", "/users/bob.json", alice, http.StatusUnauthorized},
+		{"PATCH", "/users.json", alice, http.StatusUnauthorized},
+		{"POST", "/users.json", alice, http.StatusUnauthorized},
+		{"GET", "/users/bob.json", alice, http.StatusUnauthorized},
+		{"GET", "/users.json", alice, http.StatusUnauthorized},
+		{"DELETE", "/users/bob.json", alice, http.StatusUnauthorized},
+		{"GET", "/users/alice.json", "", http.StatusUnauthorized},
+		{"GET", "/users/alice.json", ft.Secret, http.StatusOK},
+		{"GET", "/.json", ft.Secret, http.StatusOK},
+		{"GET", "/.settings/rules.json", alice, http.StatusUnauthorized},
+	} {
+		// ACT
+		body := `{"name":"x"}`
+		if strings.HasSuffix(test.path, "/.priority.json") {
+			body = "1"
+		}
+		req, err := http.NewRequest(test.method, ft.URL+test.path+"?auth="+test.auth, strings.NewReader(body))
+		require.NoError(t, err)
+		resp := httptest.NewRecorder()
+		ft.serveHTTP(resp, req)
+
+		// ASSERT
+		assert.Equal(t, test.status, resp.Code, "%s %s", test.method, test.path)
+		if test.status == http.StatusUnauthorized {
+			assert.Equal(t, permissionDenied, resp.Body.Bytes(), "%s %s", test.method, test.path)
+		}
+	}
+
+	// ACT
+	req, err = http.NewRequest("GET", ft.URL+"/.settings/rules.json?auth="+ft.Secret, nil)
+	require.NoError(t, err)
+	resp = httptest.NewRecorder()
+	ft.serveHTTP(resp, req)
+
+	// ASSERT
+	assert.Equal(t, http.StatusOK, resp.Code)
+	assert.Equal(t, rules, resp.Body.String())
+}
+
+func TestServerInvalidRules(t *testing.T) {
+	// ARRANGE
+	ft := New()
+	ft.Start()
+
+	// ACT
+	req, err := http.NewRequest("PUT", ft.URL+"/.settings/rules.json", strings.NewReader(`{"rules": {".read": 1}}`))
+	require.NoError(t, err)
+	resp := httptest.NewRecorder()
+	ft.serveHTTP(resp, req)
+
+	// ASSERT
+	assert.Equal(t, http.StatusBadRequest, resp.Code)
+	assert.Equal(t, `{"error" : "Error saving rules - /rules/.read: expected a boolean or a string"}`, resp.Body.String())
+	assert.Nil(t, ft.getRules())
+}
+
+func TestServerRulesInvalidToken(t *testing.T) {
+	// ARRANGE
+	ft := New()
+	ft.Start()
+	require.NoError(t, ft.SetRules([]byte(`{"rules": {".read": true}}`)))
+
+	// ACT
+	req, err := http.NewRequest("GET", ft.URL+"/.json?auth=bad.jwt.nope", nil)
+	require.NoError(t, err)
+	resp := httptest.NewRecorder()
+	ft.serveHTTP(resp, req)
+
+	// ASSERT
+	assert.Equal(t, http.StatusUnauthorized, resp.Code)
+	assert.Equal(t, invalidAuth, resp.Body.Bytes())
+}
+
+func TestServerConcurrentRequests(t *testing.T) {
+	// ARRANGE
+	ft := New()
+	ft.Start()
+	require.NoError(t, ft.SetRules([]byte(`{"rules": {".read": true, "foo": {".write": "newData.val() !== 'nope'"}}}`)))
+	token := testJWT(ft.Secret, map[string]interface{}{"uid": "alice"})
+
+	// ACT
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 30; j++ {
+				var (
+					method = []string{"PUT", "PATCH", "POST", "DELETE", "GET"}[j%5]
+					path   = fmt.Sprintf("/foo/%d.json?auth=%s", i%3, token)
+					body   = fmt.Sprintf(`{"count": %d, "by": %d}`, j, i)
+				)
+				req, err := http.NewRequest(method, ft.URL+path, strings.NewReader(body))
+				if !assert.NoError(t, err) {
+					return
+				}
+				resp := httptest.NewRecorder()
+				ft.serveHTTP(resp, req)
+
+				// ASSERT
+				assert.Equal(t, http.StatusOK, resp.Code, "%s %s", method, path)
+			}
+		}(i)
+	}
+
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 30; j++ {
+				ft.Set("foo/direct", j)
+				ft.Update("foo", map[string]interface{}{"other": j})
+				ft.Get("foo")
+				ft.Simulate(nil, "PUT", "/foo/direct", j)
+				ft.Delete("foo/direct")
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestServerAtomicRules(t *testing.T) {
+	// ARRANGE
+	ft := New()
+	ft.Start()
+	require.NoError(t, ft.SetRules([]byte(`{"rules": {
+		"slots": {"$slot": {".write": "!data.exists()"}},
+		"stamps": {"$id": {".write": "newData.val() == now"}}
+	}}`)))
+	token := testJWT(ft.Secret, map[string]interface{}{"uid": "alice"})
+
+	// every call to the clock returns a later time
+	var ticks int64
+	ft.SetClock(func() time.Time {
+		return time.Unix(0, atomic.AddInt64(&ticks, 1)*int64(time.Millisecond))
+	})
+
+	// ACT
+	var (
+		wg      sync.WaitGroup
+		created int32
+	)
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			req, err := http.NewRequest("PUT", ft.URL+"/slots/a.json?auth="+token, strings.NewReader(fmt.Sprint(i)))
+			if !assert.NoError(t, err) {
+				return
+			}
+			resp := httptest.NewRecorder()
+			ft.serveHTTP(resp, req)
+			if resp.Code == http.StatusOK {
+				atomic.AddInt32(&created, 1)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	// ASSERT
+	assert.Equal(t, int32(1), created, "a create-only location should only be written once")
+
+	for i := 0; i < 5; i++ {
+		// ACT
+		req, err := http.NewRequest("POST", ft.URL+"/stamps.json?auth="+token, strings.NewReader(`{".sv":"timestamp"}`))
+		require.NoError(t, err)
+		resp := httptest.NewRecorder()
+		ft.serveHTTP(resp, req)
+
+		// ASSERT
+		assert.Equal(t, http.StatusOK, resp.Code, "the timestamp should be resolved with the time the rules see")
+	}
+}
+
+// openStream opens an event stream at url and returns a function
+// reading the next event, which returns "timeout" if no event is
+// received in time, and a function closing the stream
+func openStream(t *testing.T, url string) (func() string, func()) {
+	req, err := http.NewRequest("GET", url, nil)
+	require.NoError(t, err)
+	req.Header.Set("Accept", "text/event-stream")
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+
+	events := make(chan string, 10)
+	go func() {
+		defer close(events)
+		s := bufio.NewScanner(resp.Body)
+		var lines []string
+		for s.Scan() {
+			if s.Text() != "" {
+				lines = append(lines, s.Text())
+				continue
+			}
+			events <- strings.Join(lines, "\n")
+			lines = nil
+		}
+	}()
+
+	next := func() string {
+		select {
+		case e, ok := <-events:
+			if !ok {
+				return "closed"
+			}
+			return e
+		case <-time.After(2 * time.Second):
+			return "timeout"
+		}
+	}
+	return next, func() { resp.Body.Close() }
+}
+
+func TestServerStreamEvents(t *testing.T) {
+	// ARRANGE
+	ft := New()
+	ft.Start()
+	defer ft.Close()
+	ft.Set("foo", map[string]interface{}{"bar": 1})
+
+	next, stop := openStream(t, ft.URL+"/foo.json")
+	defer stop()
+
+	// ACT & ASSERT
+	assert.Equal(t, "event: put\ndata: {\"path\":\"/\",\"data\":{\"bar\":1}}", next())
+
+	ft.Update("foo", map[string]interface{}{"baz": 2})
+	assert.Equal(t, "event: patch\ndata: {\"path\":\"/\",\"data\":{\"baz\":2}}", next())
+
+	ft.Set("foo/bar", 3)
+	assert.Equal(t, "event: put\ndata: {\"path\":\"/bar\",\"data\":3}", next())
+
+	ft.Delete("foo/baz")
+	assert.Equal(t, "event: put\ndata: {\"path\":\"/baz\",\"data\":null}", next())
+
+	ft.Set("", map[string]interface{}{"foo": "replaced"})
+	assert.Equal(t, "event: put\ndata: {\"path\":\"/\",\"data\":\"replaced\"}", next())
+}
+
+func TestServerStreamCancel(t *testing.T) {
+	// ARRANGE
+	ft := New()
+	ft.Start()
+	defer ft.Close()
+	require.NoError(t, ft.SetRules([]byte(`{"rules": {"foo": {".read": "root.child('open').val() === true"}}}`)))
+	ft.Set("open", true)
+	ft.Set("foo", 1)
+	token := testJWT(ft.Secret, map[string]interface{}{"uid": "alice"})
+
+	next, stop := openStream(t, ft.URL+"/foo.json?auth="+token)
+	defer stop()
+	assert.Equal(t, "event: put\ndata: {\"path\":\"/\",\"data\":1}", next())
+
+	// ACT
+	ft.Set("open", false)
+
+	// ASSERT
+	assert.Equal(t, "event: cancel\ndata: null", next())
+	assert.Equal(t, "closed", next())
+}
+
+func TestServerStreamWatchers(t *testing.T) {
+	// ARRANGE
+	ft := New()
+	ft.Start()
+	defer ft.Close()
+	ft.Set("foo", 1)
+	token := testJWT(ft.Secret, map[string]interface{}{"uid": "alice"})
+
+	watchers := func() []*subscriber {
+		ft.db.watchersMtx.RLock()
+		defer ft.db.watchersMtx.RUnlock()
+		return ft.db.watchers["foo"]
+	}
+
+	// ACT
+	next, stop := openStream(t, ft.URL+"/foo.json")
+	require.Equal(t, "event: put\ndata: {\"path\":\"/\",\"data\":1}", next())
+
+	// ASSERT
+	if s := watchers(); assert.Len(t, s, 1) {
+		assert.False(t, s[0].wholeTree, "streams should only watch every write when rules are loaded")
+	}
+	stop()
+
+	// ARRANGE
+	require.NoError(t, ft.SetRules([]byte(`{"rules": {".read": true}}`)))
+
+	// ACT
+	next, stop = openStream(t, ft.URL+"/foo.json?auth="+token)
+	defer stop()
+	require.Equal(t, "event: put\ndata: {\"path\":\"/\",\"data\":1}", next())
+
+	// ASSERT
+	// the first stream may not have stopped watching yet
+	if s := watchers(); assert.NotEmpty(t, s) {
+		assert.True(t, s[len(s)-1].wholeTree, "streams should watch every write when rules are loaded")
+	}
+	for i := 0; i < 2*defaultQueueSize; i++ {
+		ft.Set("other", i)
+	}
+	ft.Set("foo", 2)
+	assert.Equal(t, "event: put\ndata: {\"path\":\"/\",\"data\":2}", next())
+
+	ft.CancelStreams("foo")
+	assert.Equal(t, "event: cancel\ndata: null", next())
+}
+
+func TestServerStreamArrayPatch(t *testing.T) {
+	// ARRANGE
+	ft := New()
+	ft.Start()
+	defer ft.Close()
+	ft.Set("list", []interface{}{"a", "b", "c"})
+
+	next, stop := openStream(t, ft.URL+"/list.json")
+	defer stop()
+	require.Equal(t, "event: put\ndata: {\"path\":\"/\",\"data\":[\"a\",\"b\",\"c\"]}", next())
+
+	// ACT
+	ft.Update("list", map[string]interface{}{"1": "B"})
+	ft.Update("list", map[string]interface{}{"0": "A", "2": nil})
+
+	// ASSERT
+	assert.Equal(t, "event: patch\ndata: {\"path\":\"/\",\"data\":{\"1\":\"B\"}}", next())
+	assert.Equal(t, "event: patch\ndata: {\"path\":\"/\",\"data\":{\"0\":\"A\",\"2\":null}}", next())
+}
+
+func TestServerStreamCoverage(t *testing.T) {
+	// ARRANGE
+	ft := New()
+	ft.Start()
+	defer ft.Close()
+	require.NoError(t, ft.SetRules([]byte(`{"rules": {".read": "auth != null"}}`)))
+	token := testJWT(ft.Secret, map[string]interface{}{"uid": "alice"})
+
+	next, stop := openStream(t, ft.URL+"/foo.json?auth="+token)
+	defer stop()
+	require.Equal(t, "event: put\ndata: {\"path\":\"/\",\"data\":null}", next())
+
+	// ACT
+	ft.Set("foo", 1)
+	require.Equal(t, "event: put\ndata: {\"path\":\"/\",\"data\":1}", next())
+
+	// ASSERT
+	rc := ft.Coverage().Rules[0]
+	assert.Equal(t, int64(2), rc.Hits, "the rules should be checked once when opening the stream and once for the write")
+}
+
+func TestServerStreamConcurrentWrites(t *testing.T) {
+	// ARRANGE
+	ft := New()
+	ft.Start()
+	defer ft.Close()
+	require.NoError(t, ft.SetRules([]byte(`{"rules": {".read": "auth != null", ".write": true}}`)))
+	token := testJWT(ft.Secret, map[string]interface{}{"uid": "alice"})
+
+	// the stream is never read past the first event,
+	// so it falls behind the writers
+	next, stop := openStream(t, ft.URL+"/foo.json?auth="+token)
+	defer stop()
+	require.Equal(t, "event: put\ndata: {\"path\":\"/\",\"data\":null}", next())
+
+	// ACT
+	done := make(chan struct{})
+	go func() {
+		var wg sync.WaitGroup
+		for i := 0; i < 8; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				for j := 0; j < 200; j++ {
+					ft.Set(fmt.Sprintf("foo/%d", i), j)
+				}
+			}(i)
+		}
+		wg.Wait()
+		close(done)
+	}()
+
+	// ASSERT
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("writes should not wait on a stream that is behind")
+	}
+	assert.Equal(t, jsonNumbers(199), ft.Get("foo/7"))
+}
+
+func TestServerStreamAuthRevoked(t *testing.T) {
+	// ARRANGE
+	ft := New()
+	ft.Start()
+	defer ft.Close()
+	token := testJWTClaims(ft.Secret, map[string]interface{}{
+		"v":   0,
+		"d":   map[string]interface{}{"uid": "alice"},
+		"iat": time.Now().Unix(),
+		"exp": time.Now().Add(time.Second).Unix(),
+	})
+
+	// ACT
+	next, stop := openStream(t, ft.URL+"/foo.json?auth="+token)
+	defer stop()
+
+	// ASSERT
+	assert.Equal(t, "event: put\ndata: {\"path\":\"/\",\"data\":null}", next())
+	assert.Equal(t, "event: auth_revoked\ndata: \"credential is no longer valid\"", next())
+	assert.Equal(t, "closed", next())
+}
+
+func TestServerForceStreamEvents(t *testing.T) {
+	// ARRANGE
+	ft := New()
+	ft.Start()
+	defer ft.Close()
+
+	cancelled, stopCancelled := openStream(t, ft.URL+"/foo.json")
+	defer stopCancelled()
+	revoked, stopRevoked := openStream(t, ft.URL+"/bar.json")
+	defer stopRevoked()
+	assert.Equal(t, "event: put\ndata: {\"path\":\"/\",\"data\":null}", cancelled())
+	assert.Equal(t, "event: put\ndata: {\"path\":\"/\",\"data\":null}", revoked())
+
+	// ACT
+	ft.CancelStreams("/foo")
+	ft.RevokeStreams("bar")
+
+	// ASSERT
+	assert.Equal(t, "event: cancel\ndata: null", cancelled())
+	assert.Equal(t, "event: auth_revoked\ndata: \"credential is no longer valid\"", revoked())
+}
+
+func TestServerStreamQuery(t *testing.T) {
+	// ARRANGE
+	ft := New()
+	ft.Start()
+	defer ft.Close()
+	ft.Set("scores", map[string]interface{}{"alice": 10, "bob": 20, "carol": 30})
+
+	next, stop := openStream(t, ft.URL+`/scores.json?orderBy="$value"&limitToLast=2`)
+	defer stop()
+	assert.Equal(t, "event: put\ndata: {\"path\":\"/\",\"data\":{\"bob\":20,\"carol\":30}}", next())
+
+	// ACT & ASSERT
+	ft.Set("scores/alice", 15)
+	ft.Set("scores/bob", 25)
+	assert.Equal(t, "event: put\ndata: {\"path\":\"/bob\",\"data\":25}", next())
+
+	ft.Set("scores/alice", 40)
+	assert.Equal(t, "event: patch\ndata: {\"path\":\"/\",\"data\":{\"alice\":40,\"bob\":null}}", next())
+
+	// every write is reported with its own data,
+	// even when the stream is behind the writes
+	ft.Set("scores/alice", 50)
+	ft.Set("scores/alice", 60)
+	assert.Equal(t, "event: put\ndata: {\"path\":\"/alice\",\"data\":50}", next())
+	assert.Equal(t, "event: put\ndata: {\"path\":\"/alice\",\"data\":60}", next())
+}
+
+func TestServerStreamInvalidQuery(t *testing.T) {
+	// ARRANGE
+	ft := New()
+	ft.Start()
+	defer ft.Close()
+
+	// ACT
+	req, err := http.NewRequest("GET", ft.URL+"/scores.json?limitToLast=2", nil)
+	require.NoError(t, err)
+	req.Header.Set("Accept", "text/event-stream")
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	// ASSERT
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+}
+
+func TestServerETag(t *testing.T) {
+	// ARRANGE
+	ft := New()
+	ft.Start()
+	ft.Set("foo", "bar")
+
+	for _, test := range []struct {
+		path string
+		etag string
+	}{
+		{"/foo.json", "vbLY58qhiO1csbApX2XOXiQrQyQ="},
+		{"/nope.json", nullETag},
+	} {
+		// ACT
+		req, err := http.NewRequest("GET", ft.URL+test.path, nil)
+		require.NoError(t, err)
+		req.Header.Set("X-Firebase-ETag", "true")
+		resp := httptest.NewRecorder()
+		ft.serveHTTP(resp, req)
+
+		// ASSERT
+		assert.Equal(t, http.StatusOK, resp.Code)
+		assert.Equal(t, test.etag, resp.Header().Get("ETag"), test.path)
+	}
+}
+
+func TestServerIfMatch(t *testing.T) {
+	// ARRANGE
+	ft := New()
+	ft.Start()
+	ft.Set("foo", "bar")
+	etag := "vbLY58qhiO1csbApX2XOXiQrQyQ="
+
+	for _, test := range []struct {
+		method string
+		body   string
+		etag   string
+		status int
+		value  interface{}
+	}{
+		{"PUT", `"baz"`, "wrong", http.StatusPreconditionFailed, "bar"},
+		{"PUT", `"baz"`, etag, http.StatusOK, "baz"},
+		{"PUT", `"qux"`, etag, http.StatusPreconditionFailed, "baz"},
+		{"DELETE", "", etag, http.StatusPreconditionFailed, "baz"},
+		{"DELETE", "", newNode("baz").etag(), http.StatusOK, nil},
+		{"PUT", `"new"`, nullETag, http.StatusOK, "new"},
+	} {
+		// ACT
+		req, err := http.NewRequest(test.method, ft.URL+"/foo.json", strings.NewReader(test.body))
+		require.NoError(t, err)
+		req.Header.Set("if-match", test.etag)
+		resp := httptest.NewRecorder()
+		ft.serveHTTP(resp, req)
+
+		// ASSERT
+		assert.Equal(t, test.status, resp.Code, "%s %s", test.method, test.body)
+		assert.Equal(t, test.value, ft.Get("foo"), "%s %s", test.method, test.body)
+		if test.status == http.StatusPreconditionFailed {
+			current := newNode(ft.Get("foo"))
+			assert.Equal(t, current.etag(), resp.Header().Get("ETag"))
+			b, _ := json.Marshal(ft.Get("foo"))
+			assert.Equal(t, b, resp.Body.Bytes())
+		}
+	}
+}
+
+func TestServerErrorConditions(t *testing.T) {
+	// ARRANGE
+	ft := New()
+	ft.Start()
+	ft.SetLimits(Limits{MaxDepth: 4, MaxKeyLength: 10, MaxStringSize: 10, MaxWriteSize: 50})
+	require.NoError(t, ft.SetRules([]byte(`{"rules": {".read": true, ".write": true, "messages": {".indexOn": "author"}}}`)))
+
+	for _, test := range []struct {
+		method string
+		path   string
+		body   string
+		err    string
+	}{
+		{"PUT", "/foo.json", `{"a.b": 1}`, errInvalidKey.Error()},
+		{"PUT", "/foo.json", `{"a": {"$b": 1}}`, errInvalidKey.Error()},
+		{"PUT", "/foo.json", `{"a\u0001": 1}`, errInvalidKey.Error()},
+		{"PATCH", "/foo.json", `{"a/b#": 1}`, errInvalidKey.Error()},
+		{"PATCH", "/foo.json", `{"": 5}`, errInvalidKey.Error()},
+		{"PATCH", "/foo.json", `5`, errInvalidUpdate.Error()},
+		{"PUT", "/foo/.priority.json", `{"x": 1}`, "Invalid data; priority at /foo/.priority must be a string, a number or null"},
+		{"PATCH", "/foo.json", `[1, 2]`, errInvalidUpdate.Error()},
+		{"PATCH", "/.json", `{"/": 7}`, errInvalidKey.Error()},
+		{"POST", "/foo.json", `{"[a]": 1}`, errInvalidKey.Error()},
+		{"PUT", "/foo.json", `{"abcdefghijk": 1}`, "Invalid data; key longer than 10 bytes"},
+		{"PUT", "/foo.json", `"abcdefghijk"`, "Invalid data; string at /foo longer than 10 bytes"},
+		{"PUT", "/a/b.json", `{"c": {"d": {"e": 1}}}`, "Invalid data; path /a/b/c/d/e exceeds the maximum depth of 4"},
+		{"PATCH", "/a.json", `{"b/c/d/e": 1}`, "Invalid data; path /a/b/c/d/e exceeds the maximum depth of 4"},
+		{"PUT", "/foo.json", `{".sv": "yesterday"}`, "Invalid data; unrecognized server value at /foo"},
+		{"PUT", "/foo.json", `{".sv": "timestamp", "b": 1}`, "Invalid data; found other keys along with .value or .sv at /foo"},
+		{"PUT", "/foo.json", `{"a": {".value": 1, "b": 1}}`, "Invalid data; found other keys along with .value or .sv at /foo/a"},
+		{"PUT", "/foo.json", `"` + strings.Repeat("a", 50) + `"`, errWriteTooLarge.Error()},
+		{"GET", "/messages.json?orderBy=\"text\"", "", `Index not defined, add ".indexOn": "text", for path "/messages", to the rules`},
+		{"GET", "/messages.json?orderBy=\"$value\"", "", `Index not defined, add ".indexOn": ".value", for path "/messages", to the rules`},
+		{"GET", "/messages.json?limitToFirst=1", "", errOrderByRequired.Error()},
+	} {
+		// ACT
+		req, err := http.NewRequest(test.method, ft.URL+test.path, strings.NewReader(test.body))
+		require.NoError(t, err)
+		resp := httptest.NewRecorder()
+		ft.serveHTTP(resp, req)
+
+		// ASSERT
+		assert.Equal(t, http.StatusBadRequest, resp.Code, "%s %s %s", test.method, test.path, test.body)
+		var body map[string]string
+		require.NoError(t, json.Unmarshal(resp.Body.Bytes(), &body))
+		assert.Equal(t, test.err, body["error"], "%s %s %s", test.method, test.path, test.body)
+	}
+	assert.Nil(t, ft.Get(""), "no errored write should be stored")
+
+	// ACT
+	req, err := http.NewRequest("GET", ft.URL+`/messages.json?orderBy="author"`, nil)
+	require.NoError(t, err)
+	resp := httptest.NewRecorder()
+	ft.serveHTTP(resp, req)
+
+	// ASSERT
+	assert.Equal(t, http.StatusOK, resp.Code)
+}
+
+func TestServerInvalidPath(t *testing.T) {
+	// ARRANGE
+	ft := New()
+	ft.Start()
+
+	for _, test := range []struct {
+		method string
+		path   string
+	}{
+		{"GET", "/foo//bar.json"},
+		{"PUT", "/foo/b.r.json"},
+		{"PUT", "/foo/%24bar.json"},
+		{"PATCH", "/foo/%5Bbar%5D.json"},
+		{"POST", "/foo/.priority.json"},
+		{"DELETE", "/foo/ba%23r.json"},
+	} {
+		// ACT
+		req, err := http.NewRequest(test.method, ft.URL+test.path, strings.NewReader(`{"a":1}`))
+		require.NoError(t, err)
+		resp := httptest.NewRecorder()
+		ft.serveHTTP(resp, req)
+
+		// ASSERT
+		assert.Equal(t, http.StatusBadRequest, resp.Code, "%s %s", test.method, test.path)
+		assert.Equal(t, `{"error" : "Invalid path: Invalid token in path"}`, resp.Body.String(), "%s %s", test.method, test.path)
+	}
+	assert.Nil(t, ft.Get(""))
+
+	// ACT
+	req, err := http.NewRequest("PUT", ft.URL+"/%C3%BCber/a%20b.json", strings.NewReader(`"✓"`))
+	require.NoError(t, err)
+	resp := httptest.NewRecorder()
+	ft.serveHTTP(resp, req)
+
+	// ASSERT
+	assert.Equal(t, http.StatusOK, resp.Code)
+	assert.Equal(t, map[string]interface{}{"a b": "✓"}, ft.Get("über"))
+}
+
+func TestServerArrays(t *testing.T) {
+	// ARRANGE
+	ft := New()
+	ft.Start()
+	ft.Set("list", []interface{}{"a", "b", "c", "d"})
+
+	for _, test := range []struct {
+		method   string
+		path     string
+		body     string
+		expected string
+	}{
+		{"DELETE", "/list/1.json", "", `["a",null,"c","d"]`},
+		{"DELETE", "/list/2.json", "", `["a",null,null,"d"]`},
+		{"DELETE", "/list/0.json", "", `{"3":"d"}`},
+		{"PUT", "/list/1.json", `"b"`, `[null,"b",null,"d"]`},
+		{"PUT", "/list.json", `{"0": "a", "1": "b"}`, `["a","b"]`},
+	} {
+		// ACT
+		req, err := http.NewRequest(test.method, ft.URL+test.path, strings.NewReader(test.body))
+		require.NoError(t, err)
+		resp := httptest.NewRecorder()
+		ft.serveHTTP(resp, req)
+		require.Equal(t, http.StatusOK, resp.Code)
+
+		req, err = http.NewRequest("GET", ft.URL+"/list.json", nil)
+		require.NoError(t, err)
+		resp = httptest.NewRecorder()
+		ft.serveHTTP(resp, req)
+
+		// ASSERT
+		assert.Equal(t, test.expected, resp.Body.String(), "%s %s", test.method, test.path)
+	}
+}
+
+func TestServerNullWrites(t *testing.T) {
+	// ARRANGE
+	ft := New()
+	ft.Start()
+
+	for _, test := range []struct {
+		method string
+		body   string
+	}{
+		{"PUT", `null`},
+		{"PUT", `{}`},
+		{"PUT", `{"a": null, "b": {"c": null}}`},
+		{"PATCH", `{"x": null, "z": {}}`},
+		{"PATCH", `{"x/y": null, "z": {"w": null}}`},
+	} {
+		ft.Set("foo/bar", map[string]interface{}{"x": map[string]interface{}{"y": 1}, "z": 2})
+
+		// ACT
+		req, err := http.NewRequest(test.method, ft.URL+"/foo/bar.json", strings.NewReader(test.body))
+		require.NoError(t, err)
+		resp := httptest.NewRecorder()
+		ft.serveHTTP(resp, req)
+		require.Equal(t, http.StatusOK, resp.Code, "%s %s", test.method, test.body)
+
+		req, err = http.NewRequest("GET", ft.URL+"/.json", nil)
+		require.NoError(t, err)
+		resp = httptest.NewRecorder()
+		ft.serveHTTP(resp, req)
+
+		// ASSERT
+		assert.Equal(t, "null", resp.Body.String(), "%s %s", test.method, test.body)
+	}
+}
+
+func TestServerKeyOrder(t *testing.T) {
+	// ARRANGE
+	ft := New()
+	ft.Start()
+	ft.Set("foo", map[string]interface{}{"b": 1, "a": 2, "10": 3, "9": 4})
+
+	for _, test := range []struct {
+		query    string
+		expected string
+	}{
+		{"", `{"9":4,"10":3,"a":2,"b":1}`},
+		{"?print=pretty", "{\n  \"9\": 4,\n  \"10\": 3,\n  \"a\": 2,\n  \"b\": 1\n}"},
+		{`?orderBy="$value"&limitToLast=3`, `{"9":4,"10":3,"a":2}`},
+		{"?format=export", `{"9":4,"10":3,"a":2,"b":1}`},
+	} {
+		// ACT
+		req, err := http.NewRequest("GET", ft.URL+"/foo.json"+test.query, nil)
+		require.NoError(t, err)
+		resp := httptest.NewRecorder()
+		ft.serveHTTP(resp, req)
+
+		// ASSERT
+		assert.Equal(t, http.StatusOK, resp.Code, test.query)
+		assert.Equal(t, test.expected, resp.Body.String(), test.query)
+	}
+}
@@ -0,0 +1,148 @@
+package firetest
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// RuleEvaluation describes a single evaluation of a rule expression
+type RuleEvaluation struct {
+	// Rule is the location of the rule in the rules
+	// document, e.g. /rules/users/$uid/.write
+	Rule string
+	// Expression is the source of the rule
+	Expression string
+	// Path is the data location the rule was evaluated at
+	Path string
+	// Result is true if the rule evaluated to true
+	Result bool
+	// Error is set if the rule could not be evaluated,
+	// in which case it counts as false
+	Error string
+}
+
+// Simulation is the outcome of simulating a request
+// against the security rules
+type Simulation struct {
+	// Allowed is true if the request would be permitted
+	Allowed bool
+	// Rule is the location of the rule that decided the result.
+	// It is empty when no rules are loaded or when access was
+	// denied because no rule granted it.
+	Rule string
+	// Expression is the source of the deciding rule
+	Expression string
+	// Reason explains why the request was allowed or denied
+	Reason string
+	// Evaluations lists every rule evaluated, in order
+	Evaluations []RuleEvaluation
+}
+
+// String returns the decision along with its reason and
+// the rules that were evaluated, one per line.
+func (s Simulation) String() string {
+	decision := "denied"
+	if s.Allowed {
+		decision = "allowed"
+	}
+
+	lines := []string{decision + ": " + s.Reason}
+	for _, e := range s.Evaluations {
+		line := fmt.Sprintf("  %s at %s: %q => %t", e.Rule, e.Path, e.Expression, e.Result)
+		if e.Error != "" {
+			line += " (" + e.Error + ")"
+		}
+		lines = append(lines, line)
+	}
+	return strings.Join(lines, "\n")
+}
+
+// errSimulated aborts the writes made to simulate a request
+var errSimulated = errors.New("firetest: simulated write")
+
+// Simulate evaluates the security rules for a request without
+// performing it. The method is one of GET, PUT, PATCH, POST and
+// DELETE, auth is the value of the auth rules variable, nil for
+// unauthenticated requests, and data is the body of a write.
+//
+// Rules are evaluated against the current data in the server. If
+// no rules are loaded every request is allowed.
+func (ft *Firetest) Simulate(auth interface{}, method, path string, data interface{}) (Simulation, error) {
+	path, err := ft.validPath(path)
+	if err != nil {
+		return Simulation{}, err
+	}
+
+	var (
+		sim Simulation
+		d   ruleDecision
+		r   = ft.getRules()
+	)
+	observe := func(r *rule, env *ruleEnv, result bool, err error) {
+		e := RuleEvaluation{
+			Rule:       r.location,
+			Expression: r.source,
+			Path:       env.location(),
+			Result:     result && err == nil,
+		}
+		if err != nil {
+			e.Error = err.Error()
+		}
+		sim.Evaluations = append(sim.Evaluations, e)
+	}
+
+	// writes are made as usual, but the check that
+	// evaluates the rules always keeps them from happening
+	check := func(w write) error {
+		if r != nil {
+			env := &ruleEnv{auth: auth, now: millis(w.now), root: w.root, observe: observe}
+			d = r.writeAt(env, w.path, w.change, w.locations...)
+		}
+		return errSimulated
+	}
+
+	op := "write"
+	switch strings.ToUpper(method) {
+	case "GET":
+		op = "read"
+		if p, ok := priorityPath(path); ok {
+			path = p
+		}
+		if r != nil {
+			ft.db.view(func(root *node, now time.Time) {
+				d = r.read(&ruleEnv{auth: auth, now: millis(now), root: root, observe: observe}, path)
+			})
+		}
+	case "PUT":
+		_, err = ft.setIf(path, data, check)
+	case "PATCH":
+		_, err = ft.updateIf(path, data, check)
+	case "POST":
+		// use a separate generator so simulations
+		// don't change the names given to new children
+		path = joinPath(path, newPushIDGenerator(0).next(ft.db.now()))
+		if err = ft.getLimits().checkData(path, data); err == nil {
+			_, err = ft.db.addIf(path, newNode(data), check)
+		}
+	case "DELETE":
+		_, err = ft.setIf(path, nil, check)
+	default:
+		return Simulation{}, fmt.Errorf("firetest: cannot simulate method %q", method)
+	}
+	if err != nil && err != errSimulated {
+		return Simulation{}, err
+	}
+
+	if r == nil {
+		return Simulation{Allowed: true, Reason: ruleDecision{allowed: true}.reason(op)}, nil
+	}
+
+	sim.Allowed = d.allowed
+	sim.Reason = d.reason(op)
+	if d.rule != nil {
+		sim.Rule, sim.Expression = d.rule.location, d.rule.source
+	}
+	return sim, nil
+}
@@ -0,0 +1,170 @@
+package firetest
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSimulateWithoutRules(t *testing.T) {
+	ft := New()
+
+	sim, err := ft.Simulate(nil, "DELETE", "/foo", nil)
+	require.NoError(t, err)
+	assert.True(t, sim.Allowed)
+	assert.Equal(t, "no security rules are loaded", sim.Reason)
+	assert.Empty(t, sim.Evaluations)
+}
+
+func TestSimulateInvalidMethod(t *testing.T) {
+	ft := New()
+
+	_, err := ft.Simulate(nil, "HEAD", "/foo", nil)
+	assert.Error(t, err)
+
+	_, err = ft.Simulate(nil, "GET", "/foo/b.r", nil)
+	assert.IsType(t, &PathError{}, err)
+}
+
+func TestSimulate(t *testing.T) {
+	ft := New()
+	require.NoError(t, ft.SetRules([]byte(testRules)))
+	ft.Set("users/alice", map[string]interface{}{"name": "Alice"})
+
+	alice := map[string]interface{}{"uid": "alice"}
+	for _, test := range []struct {
+		name       string
+		auth       interface{}
+		method     string
+		path       string
+		data       interface{}
+		allowed    bool
+		rule       string
+		expression string
+		reason     string
+	}{
+		{
+			name:       "read own user",
+			auth:       alice,
+			method:     "GET",
+			path:       "/users/alice/name",
+			allowed:    true,
+			rule:       "/rules/users/$uid/.read",
+			expression: "auth != null && auth.uid === $uid",
+			reason:     "read access granted by /rules/users/$uid/.read at /users/alice",
+		},
+		{
+			name:   "read other user",
+			auth:   alice,
+			method: "get",
+			path:   "/users/bob",
+			reason: "no .read rule granted access to /users/bob",
+		},
+		{
+			name:       "update own user",
+			auth:       alice,
+			method:     "PATCH",
+			path:       "/users/alice",
+			data:       map[string]interface{}{"age": 30},
+			allowed:    true,
+			rule:       "/rules/users/$uid/.write",
+			expression: "auth != null && auth.uid === $uid",
+			reason:     "write access granted by /rules/users/$uid/.write at /users/alice",
+		},
+		{
+			name:       "invalid name",
+			auth:       alice,
+			method:     "PUT",
+			path:       "/users/alice/name",
+			data:       true,
+			rule:       "/rules/users/$uid/name/.validate",
+			expression: "newData.isString() && newData.val().length < 10",
+			reason:     "validation failed by /rules/users/$uid/name/.validate at /users/alice/name",
+		},
+		{
+			name:   "anonymous delete",
+			method: "DELETE",
+			path:   "/users/alice",
+			reason: "no .write rule granted access to /users/alice",
+		},
+		{
+			name:       "post message",
+			auth:       alice,
+			method:     "POST",
+			path:       "/messages",
+			data:       map[string]interface{}{"author": "alice"},
+			allowed:    true,
+			rule:       "/rules/messages/$id/.write",
+			expression: "!data.exists() && newData.child('author').val() === auth.uid",
+		},
+	} {
+		sim, err := ft.Simulate(test.auth, test.method, test.path, test.data)
+		require.NoError(t, err, test.name)
+
+		assert.Equal(t, test.allowed, sim.Allowed, "%s\n%s", test.name, sim)
+		assert.Equal(t, test.rule, sim.Rule, test.name)
+		assert.Equal(t, test.expression, sim.Expression, test.name)
+		if test.reason != "" {
+			assert.Equal(t, test.reason, sim.Reason, test.name)
+		}
+		assert.NotEmpty(t, sim.Evaluations, test.name)
+	}
+
+	// the simulation must not modify the data
+	assert.Equal(t, map[string]interface{}{"name": "Alice"}, ft.Get("users/alice"))
+	assert.Nil(t, ft.Get("messages"))
+}
+
+func TestSimulateEvaluations(t *testing.T) {
+	ft := New()
+	require.NoError(t, ft.SetRules([]byte(testRules)))
+
+	sim, err := ft.Simulate(nil, "GET", "/users/alice", nil)
+	require.NoError(t, err)
+
+	assert.Equal(t, []RuleEvaluation{
+		{
+			Rule:       "/rules/.read",
+			Expression: "auth != null && auth.admin === true",
+			Path:       "/",
+		},
+		{
+			Rule:       "/rules/users/$uid/.read",
+			Expression: "auth != null && auth.uid === $uid",
+			Path:       "/users/alice",
+		},
+	}, sim.Evaluations)
+
+	sim, err = ft.Simulate(map[string]interface{}{}, "GET", "/users/alice", nil)
+	require.NoError(t, err)
+	assert.Equal(t, "denied: no .read rule granted access to /users/alice\n"+
+		"  /rules/.read at /: \"auth != null && auth.admin === true\" => false\n"+
+		"  /rules/users/$uid/.read at /users/alice: \"auth != null && auth.uid === $uid\" => false",
+		sim.String())
+}
+
+func TestSimulateServerValues(t *testing.T) {
+	ft := New()
+	ft.SetClock(func() time.Time { return time.Unix(1437139539, 0) })
+	require.NoError(t, ft.SetRules([]byte(`{"rules": {
+		"stamps": {"$id": {".write": "newData.val() === now"}}
+	}}`)))
+
+	for _, method := range []string{"PUT", "PATCH", "POST"} {
+		path, data := "/stamps/a", interface{}(map[string]interface{}{".sv": "timestamp"})
+		switch method {
+		case "PATCH":
+			data = map[string]interface{}{"a": data}
+			path = "/stamps"
+		case "POST":
+			path = "/stamps"
+		}
+
+		sim, err := ft.Simulate(nil, method, path, data)
+		require.NoError(t, err, method)
+		assert.True(t, sim.Allowed, "%s\n%s", method, sim)
+	}
+	assert.Nil(t, ft.Get("stamps"), "the simulation must not modify the data")
+}
@@ -0,0 +1,163 @@
+package firetest
+
+import (
+	"sync"
+	"time"
+)
+
+// OverflowPolicy determines what happens to the events of
+// a subscriber whose queue is full because it is not
+// receiving them as fast as they are produced
+type OverflowPolicy int
+
+const (
+	// OverflowBlock makes writes wait, once they are done, until
+	// the subscriber has room in its queue. No events are lost,
+	// but a subscriber that writes while it is behind will
+	// deadlock, and one that stops receiving holds up every write.
+	OverflowBlock OverflowPolicy = iota
+	// OverflowDropOldest discards the oldest queued event
+	// to make room for the new one
+	OverflowDropOldest
+	// OverflowDisconnect makes writes wait, once they are done,
+	// up to 250 milliseconds for room in the queue, after which
+	// the subscription ends, delivering the queued events
+	// followed by a cancel event
+	OverflowDisconnect
+)
+
+const defaultQueueSize = 1000
+
+// overflowWait is how long a write waits for room in the queue
+// of a subscriber with the OverflowDisconnect policy
+const overflowWait = 250 * time.Millisecond
+
+// subscriber delivers the events for a watched location in the
+// order they were produced. Events are queued so that producers
+// never wait on the receiver while they push, which they may do
+// while holding locks. Producers that must wait for room in the
+// queue do so afterwards with wait.
+type subscriber struct {
+	c      chan event
+	stop   chan struct{}
+	size   int
+	policy OverflowPolicy
+	// wholeTree is set for subscribers that receive the
+	// events of the whole tree instead of those at their path
+	wholeTree bool
+
+	mtx   sync.Mutex
+	cond  *sync.Cond
+	queue []event
+	// closed is set once no more events will be queued
+	// and stopped once the receiver is no longer listening
+	closed, stopped bool
+}
+
+func newSubscriber(size int, policy OverflowPolicy) *subscriber {
+	if size < 1 {
+		size = 1
+	}
+
+	s := &subscriber{
+		c:      make(chan event),
+		stop:   make(chan struct{}),
+		size:   size,
+		policy: policy,
+	}
+	s.cond = sync.NewCond(&s.mtx)
+	go s.run()
+	return s
+}
+
+// push queues e for delivery according to the overflow policy.
+// It never blocks, so the queue grows past its size until the
+// producer calls wait.
+func (s *subscriber) push(e event) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	if s.closed || s.stopped {
+		return
+	}
+	if len(s.queue) >= s.size && s.policy == OverflowDropOldest {
+		s.queue = s.queue[1:]
+	}
+
+	s.queue = append(s.queue, e)
+	s.cond.Broadcast()
+}
+
+// wait blocks until the queue is no longer over its size or the
+// subscriber is closed. Under OverflowDisconnect it gives up after
+// overflowWait and ends the subscription instead.
+func (s *subscriber) wait() {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	over := func() bool {
+		return len(s.queue) > s.size && !s.closed && !s.stopped
+	}
+	if !over() {
+		return
+	}
+
+	var expired bool
+	if s.policy == OverflowDisconnect {
+		timer := time.AfterFunc(overflowWait, func() {
+			s.mtx.Lock()
+			expired = true
+			s.cond.Broadcast()
+			s.mtx.Unlock()
+		})
+		defer timer.Stop()
+	}
+
+	for over() && !expired {
+		s.cond.Wait()
+	}
+	if over() {
+		s.queue = append(s.queue, event{Name: eventCancel})
+		s.closed = true
+		s.cond.Broadcast()
+	}
+}
+
+// close stops the delivery of events, discarding any that are queued
+func (s *subscriber) close() {
+	s.mtx.Lock()
+	if !s.stopped {
+		s.stopped = true
+		close(s.stop)
+		s.cond.Broadcast()
+	}
+	s.mtx.Unlock()
+}
+
+// run delivers the queued events until the subscriber is
+// closed, after which the channel is closed
+func (s *subscriber) run() {
+	defer close(s.c)
+
+	for {
+		s.mtx.Lock()
+		for len(s.queue) == 0 && !s.closed && !s.stopped {
+			s.cond.Wait()
+		}
+		if s.stopped || len(s.queue) == 0 {
+			s.mtx.Unlock()
+			return
+		}
+
+		e := s.queue[0]
+		s.queue = s.queue[1:]
+		s.cond.Broadcast()
+		s.mtx.Unlock()
+
+		select {
+		case s.c <- e:
+		case <-s.stop:
+			return
+		}
+	}
+}
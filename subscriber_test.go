@@ -0,0 +1,174 @@
+package firetest
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func testEvent(i int) event {
+	return newEvent(eventPut, "", newNode(i))
+}
+
+func receive(s *subscriber) []interface{} {
+	var values []interface{}
+	for {
+		select {
+		case e, ok := <-s.c:
+			if !ok {
+				return values
+			}
+			if e.Name == eventCancel {
+				values = append(values, eventCancel)
+				continue
+			}
+			values = append(values, e.Data.Data.value)
+		case <-time.After(50 * time.Millisecond):
+			return values
+		}
+	}
+}
+
+// waitQueued waits until there are n events in the queue of s
+func waitQueued(s *subscriber, n int) {
+	s.mtx.Lock()
+	for len(s.queue) != n {
+		s.cond.Wait()
+	}
+	s.mtx.Unlock()
+}
+
+func TestSubscriberOrder(t *testing.T) {
+	s := newSubscriber(defaultQueueSize, OverflowBlock)
+	defer s.close()
+
+	for i := 0; i < 10; i++ {
+		s.push(testEvent(i))
+	}
+	assert.Equal(t, jsonNumbers([]interface{}{0, 1, 2, 3, 4, 5, 6, 7, 8, 9}), receive(s))
+}
+
+func TestSubscriberBlock(t *testing.T) {
+	s := newSubscriber(2, OverflowBlock)
+	defer s.close()
+
+	pushed := make(chan struct{})
+	go func() {
+		for i := 0; i < 5; i++ {
+			s.push(testEvent(i))
+			s.wait()
+		}
+		close(pushed)
+	}()
+
+	select {
+	case <-pushed:
+		t.Fatal("wait should block while the queue is over its size")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	assert.Equal(t, jsonNumbers([]interface{}{0, 1, 2, 3, 4}), receive(s))
+	<-pushed
+}
+
+func TestSubscriberBlockClose(t *testing.T) {
+	s := newSubscriber(1, OverflowBlock)
+
+	// the first event is taken off the queue by the
+	// delivery goroutine while it waits on the receiver
+	s.push(testEvent(0))
+	waitQueued(s, 0)
+
+	pushed := make(chan struct{})
+	go func() {
+		for i := 1; i < 5; i++ {
+			s.push(testEvent(i))
+			s.wait()
+		}
+		close(pushed)
+	}()
+
+	// the queue is over its size after the second push
+	waitQueued(s, 2)
+	s.close()
+
+	select {
+	case <-pushed:
+	case <-time.After(time.Second):
+		t.Fatal("closing the subscriber should release blocked waits")
+	}
+}
+
+func TestSubscriberPushNeverBlocks(t *testing.T) {
+	s := newSubscriber(1, OverflowBlock)
+	defer s.close()
+
+	s.push(testEvent(0))
+	waitQueued(s, 0)
+	for i := 1; i < 5; i++ {
+		s.push(testEvent(i))
+	}
+	waitQueued(s, 4)
+	assert.Equal(t, jsonNumbers([]interface{}{0, 1, 2, 3, 4}), receive(s))
+}
+
+func TestSubscriberDropOldest(t *testing.T) {
+	s := newSubscriber(2, OverflowDropOldest)
+	defer s.close()
+
+	// the first event is taken off the queue by the
+	// delivery goroutine while it waits on the receiver
+	s.push(testEvent(0))
+	waitQueued(s, 0)
+	for i := 1; i < 5; i++ {
+		s.push(testEvent(i))
+	}
+	assert.Equal(t, jsonNumbers([]interface{}{0, 3, 4}), receive(s))
+}
+
+func TestSubscriberDisconnect(t *testing.T) {
+	s := newSubscriber(2, OverflowDisconnect)
+
+	s.push(testEvent(0))
+	waitQueued(s, 0)
+	for i := 1; i < 5; i++ {
+		s.push(testEvent(i))
+	}
+	s.wait()
+	s.push(testEvent(5))
+
+	assert.Equal(t, jsonNumbers([]interface{}{0, 1, 2, 3, 4, eventCancel}), receive(s))
+	_, ok := <-s.c
+	assert.False(t, ok, "channel should be closed after a disconnect")
+}
+
+func TestSubscriberDisconnectCatchUp(t *testing.T) {
+	s := newSubscriber(2, OverflowDisconnect)
+	defer s.close()
+
+	for i := 0; i < 5; i++ {
+		s.push(testEvent(i))
+	}
+	received := make(chan []interface{})
+	go func() {
+		received <- receive(s)
+	}()
+	s.wait()
+
+	assert.Equal(t, jsonNumbers([]interface{}{0, 1, 2, 3, 4}), <-received)
+}
+
+func TestSubscriberClose(t *testing.T) {
+	s := newSubscriber(defaultQueueSize, OverflowBlock)
+	s.push(testEvent(0))
+	s.push(testEvent(1))
+	s.close()
+	s.push(testEvent(2))
+
+	_, ok := <-s.c
+	for ok {
+		_, ok = <-s.c
+	}
+	assert.False(t, ok)
+}
@@ -10,6 +10,13 @@ import (
 type event struct {
 	Name string
 	Data eventData
+
+	// before and after are the values at Data.Path before and
+	// after the change, which are only copied for watchers that
+	// need them
+	before, after *node
+	// now is the time of the change according to the tree's clock
+	now time.Time
 }
 
 type eventData struct {
@@ -24,9 +31,17 @@ func (ed eventData) MarshalJSON() ([]byte, error) {
 	return json.Marshal(ed2)
 }
 
+const (
+	eventPut    = "put"
+	eventPatch  = "patch"
+	eventCancel = "cancel"
+
+	eventAuthRevoked = "auth_revoked"
+)
+
 func newEvent(name, path string, n *node) event {
 	return event{
-		Name: "put",
+		Name: name,
 		Data: eventData{
 			Path: path,
 			Data: n,
@@ -34,11 +49,76 @@ func newEvent(name, path string, n *node) event {
 	}
 }
 
+// apply returns a copy of n, the data at the location the event is
+// relative to, with the change carried by the event. Only the nodes
+// along the changed path are copied. Events without data return n.
+func (e event) apply(n *node) *node {
+	switch e.Name {
+	case eventPut:
+		return applyWrite(n, e.Data.Path, func(*node) *node { return e.Data.Data })
+	case eventPatch:
+		return applyWrite(n, e.Data.Path, func(old *node) *node {
+			return patched(old, e.Data.Data)
+		})
+	}
+	return n
+}
+
+// relativeTo returns the event as seen by a watcher at path. Changes
+// at or below the watcher are reported relative to it, while changes
+// above it are reported as a put of the watcher's part of the data.
+// It returns false if the change does not affect the watcher.
+func (e event) relativeTo(path string) (event, bool) {
+	if rel, ok := relativePath(path, e.Data.Path); ok {
+		e.Data.Path = rel
+		return e, true
+	}
+
+	rel, ok := relativePath(e.Data.Path, path)
+	if !ok {
+		return e, false
+	}
+
+	data := e.Data.Data
+	e.before, e.after = e.before.child(rel), e.after.child(rel)
+	if e.Name == eventPatch && data != nil && data.value == nil {
+		// a patch only replaces the locations it contains, which
+		// are either above or below the watcher but not both
+		below := &node{children: map[string]*node{}}
+		for k, child := range data.children {
+			if sub, ok := relativePath(k, rel); ok {
+				e.Name, e.Data = eventPut, eventData{Data: child.child(sub)}
+				return e, true
+			}
+			if sub, ok := relativePath(rel, k); ok {
+				below.children[sub] = child
+			}
+		}
+		if len(below.children) == 0 {
+			return e, false
+		}
+
+		e.Data = eventData{Data: below}
+		return e, true
+	}
+
+	e.Name = eventPut
+	e.Data = eventData{Data: data.child(rel)}
+	return e, true
+}
+
+// treeDB stores the data of a Firetest server. All access to the
+// nodes goes through mtx, and nodes are copied before they leave
+// the tree so that callers never share them with a writer.
 type treeDB struct {
+	mtx      sync.RWMutex
 	rootNode *node
+	clock    func() time.Time
 
 	watchersMtx sync.RWMutex
-	watchers    map[string][]chan event
+	watchers    map[string][]*subscriber
+	queueSize   int
+	overflow    OverflowPolicy
 }
 
 func newTree() *treeDB {
@@ -46,13 +126,104 @@ func newTree() *treeDB {
 		rootNode: &node{
 			children: map[string]*node{},
 		},
-		watchers: map[string][]chan event{},
+		clock:     time.Now,
+		watchers:  map[string][]*subscriber{},
+		queueSize: defaultQueueSize,
+		overflow:  OverflowDisconnect,
+	}
+}
+
+// now returns the current time according to the tree's clock
+func (tree *treeDB) now() time.Time {
+	tree.mtx.RLock()
+	defer tree.mtx.RUnlock()
+	return tree.clock()
+}
+
+// setClock sets the function used to get the current time
+func (tree *treeDB) setClock(clock func() time.Time) {
+	tree.mtx.Lock()
+	tree.clock = clock
+	tree.mtx.Unlock()
+}
+
+// resolveValues replaces the server values found in n, which is
+// about to be written at path, with their actual values. It is
+// called with the lock held.
+func (tree *treeDB) resolveValues(path string, n *node, now time.Time) {
+	if sv, ok := n.value.(*serverValue); ok {
+		n.value = sv.resolve(now, tree.lookup(path))
+		return
+	}
+
+	for k, child := range n.children {
+		tree.resolveValues(joinPath(path, k), child, now)
+	}
+}
+
+// write describes a change about to be made to the tree
+type write struct {
+	// root is the data before the change and now is the
+	// time used to resolve the server values it writes
+	root *node
+	now  time.Time
+
+	// change is made to the node at path, which writes
+	// the given locations, the path itself if there are none
+	path      string
+	change    func(*node) *node
+	locations []string
+}
+
+// writeCheck decides whether a write can be made, returning an
+// error if it cannot. It is called with the lock held, so that
+// nothing changes between the check and the write.
+type writeCheck func(w write) error
+
+// checkWrite resolves the server values in n and calls check, if
+// any, with the write it describes, for callers holding the lock
+func (tree *treeDB) checkWrite(check writeCheck, n *node, w write) error {
+	w.root, w.now = tree.rootNode, tree.clock()
+	if n != nil {
+		tree.resolveValues(w.path, n, w.now)
+	}
+	if check == nil {
+		return nil
+	}
+	return check(w)
+}
+
+// addIf stores n at path, removing the data there instead if n has
+// no data, if check allows it. It returns a copy of the data stored,
+// which is nil for a delete.
+func (tree *treeDB) addIf(path string, n *node, check writeCheck) (*node, error) {
+	tree.mtx.Lock()
+	err := tree.checkWrite(check, n, write{
+		path:   path,
+		change: func(*node) *node { return n },
+	})
+	if err != nil {
+		tree.mtx.Unlock()
+		return nil, err
+	}
+
+	before := tree.snapshot(path)
+	if n.isNil() {
+		tree.remove(path)
+		tree.unlockAndNotify(newEvent(eventPut, path, nil), before)
+		return nil, nil
 	}
+	tree.set(path, n)
+	stored := n.clone()
+	tree.unlockAndNotify(newEvent(eventPut, path, stored), before)
+	return stored, nil
 }
 
-func (tree *treeDB) add(path string, n *node) {
-	defer func() { go tree.notify(newEvent("put", path, n)) }()
+// set stores n at path for callers holding the lock
+func (tree *treeDB) set(path string, n *node) {
+	tree.resolveValues(path, n, tree.clock())
 	if path == "" {
+		n.parent = nil
 		tree.rootNode = n
 		return
 	}
@@ -78,35 +249,75 @@ func (tree *treeDB) add(path string, n *node) {
 	n.parent = current
 }
 
-func (tree *treeDB) update(path string, n *node) {
-	current := tree.rootNode
-	rabbitHole := strings.Split(path, "/")
+// updateIf writes each child of n at the location found by joining
+// path with its key, which can span several levels, and removes
+// those locations for children without data, if check allows it.
+// All the children are written at once and reported as a single
+// patch event. It returns a copy of n with its server values resolved.
+func (tree *treeDB) updateIf(path string, n *node, check writeCheck) (*node, error) {
+	var locations []string
+	for k := range n.children {
+		locations = append(locations, joinPath(path, k))
+	}
 
-	for i := 0; i < len(rabbitHole); i++ {
-		path := rabbitHole[i]
-		if path == "" {
-			// prevent against empty strings due to strings.Split
-			continue
-		}
-		next, ok := current.children[path]
-		if !ok {
-			next = &node{parent: current, children: map[string]*node{}}
-			current.children[path] = next
+	tree.mtx.Lock()
+	err := tree.checkWrite(check, n, write{
+		path:      path,
+		change:    func(old *node) *node { return patched(old, n) },
+		locations: locations,
+	})
+	if err != nil {
+		tree.mtx.Unlock()
+		return nil, err
+	}
+
+	before := tree.snapshot(path)
+
+	if n.value != nil {
+		// not an object, so the value is replaced
+		if current := tree.lookup(path); n.priority == nil && current != nil {
+			n.priority = current.priority
 		}
-		next.value = nil // no long has a value since it now has a child
-		current, next = next, nil
+		tree.set(path, n)
 	}
 
-	current.merge(n)
+	for k, child := range n.children {
+		if child.isNil() {
+			tree.remove(joinPath(path, k))
+			continue
+		}
+		tree.set(joinPath(path, k), child)
+	}
 
-	go tree.notify(newEvent("patch", path, n))
+	if current := tree.lookup(path); n.priority != nil && !current.isNil() {
+		current.priority = n.priority
+	}
+	stored := n.clone()
+	tree.unlockAndNotify(newEvent(eventPatch, path, stored), before)
+	return stored, nil
 }
 
-func (tree *treeDB) del(path string) {
-	defer func() {
-		go tree.notify(newEvent("put", path, nil))
-	}()
+// patched returns a copy of n updated with patch the way update
+// would, sharing the unchanged nodes with n
+func patched(n, patch *node) *node {
+	cp := n.copy()
+	cp.value = patch.value
+	for k, child := range patch.children {
+		cp = applyWrite(cp, k, func(*node) *node {
+			if child.isNil() {
+				return nil
+			}
+			return child
+		})
+	}
+	if patch.priority != nil {
+		cp.priority = patch.priority
+	}
+	return cp
+}
 
+// remove deletes the node at path for callers holding the lock
+func (tree *treeDB) remove(path string) {
 	if path == "" {
 		tree.rootNode = &node{
 			children: map[string]*node{},
@@ -129,21 +340,69 @@ func (tree *treeDB) del(path string) {
 		current = next
 	}
 
-	endNode := current
-	leafPath := rabbitHole[delIdx]
-	delete(endNode.children, leafPath)
+	delete(current.children, rabbitHole[delIdx])
 
-	for tmp := endNode.prune(); tmp != nil; tmp = tmp.prune() {
+	// remove the ancestors left without data
+	for parent := current.prune(); parent != nil; parent = parent.prune() {
 		delIdx--
-		endNode = tmp
+		delete(parent.children, rabbitHole[delIdx])
 	}
+}
+
+// setPriorityIf sets the priority of the node at path if check allows
+// it. It returns a copy of the node whose priority was set, which is
+// nil if there is no data at path.
+func (tree *treeDB) setPriorityIf(path string, priority interface{}, check writeCheck) (*node, error) {
+	tree.mtx.Lock()
+	err := tree.checkWrite(check, nil, write{
+		path: path,
+		change: func(old *node) *node {
+			if old.isNil() {
+				return old
+			}
 
-	if endNode != nil {
-		delete(endNode.children, rabbitHole[delIdx])
+			n := old.copy()
+			n.priority = priority
+			return n
+		},
+	})
+	if err != nil {
+		tree.mtx.Unlock()
+		return nil, err
 	}
+
+	n := tree.lookup(path)
+	if n.isNil() {
+		// priorities cannot be stored on empty locations
+		tree.mtx.Unlock()
+		return nil, nil
+	}
+
+	before := tree.snapshot(path)
+	n.priority = priority
+	stored := n.clone()
+	tree.unlockAndNotify(newEvent(eventPut, path, stored), before)
+	return stored, nil
 }
 
+// get returns a copy of the node at path, or nil
+// if there is no data at path
 func (tree *treeDB) get(path string) *node {
+	tree.mtx.RLock()
+	defer tree.mtx.RUnlock()
+	return tree.lookup(path).clone()
+}
+
+// view calls fn with the root of the tree and the current time,
+// holding the lock for reading. fn must not change nor keep the nodes.
+func (tree *treeDB) view(fn func(root *node, now time.Time)) {
+	tree.mtx.RLock()
+	defer tree.mtx.RUnlock()
+	fn(tree.rootNode, tree.clock())
+}
+
+// lookup returns the node stored at path for callers holding the lock
+func (tree *treeDB) lookup(path string) *node {
 	current := tree.rootNode
 	if path == "" {
 		return current
@@ -160,53 +419,157 @@ func (tree *treeDB) get(path string) *node {
 	return current
 }
 
-func (tree *treeDB) notify(e event) {
-	tree.watchersMtx.RLock()
-	for path, listeners := range tree.watchers {
-		if !strings.HasPrefix(e.Data.Path, path) {
-			continue
-		}
+// unlockAndNotify queues e for the watchers and releases mtx,
+// which must be held for writing, so that events are queued in
+// the order of the writes. before is the snapshot of the location
+// of e prior to the write. Only once the lock is released does
+// the writer wait for the watchers that are behind.
+func (tree *treeDB) unlockAndNotify(e event, before *node) {
+	e.before, e.now = before, tree.clock()
+	if e.Name == eventPut {
+		e.after = e.Data.Data
+	} else {
+		e.after = tree.snapshot(e.Data.Path)
+	}
 
-		// Make sure to not return full path when notifying
-		// only return the path relative to the watcher
-		e.Data.Path = strings.TrimPrefix(e.Data.Path, path)
-		e.Data.Path = sanitizePath(e.Data.Path)
+	subscribers := tree.notify(e)
+	tree.mtx.Unlock()
+	for _, s := range subscribers {
+		s.wait()
+	}
+}
 
-		for _, c := range listeners {
-			select {
-			case c <- e:
-			case <-time.After(250 * time.Millisecond):
+// notify queues e for the watchers it concerns and returns them
+func (tree *treeDB) notify(e event) []*subscriber {
+	tree.watchersMtx.RLock()
+	defer tree.watchersMtx.RUnlock()
+
+	var notified []*subscriber
+	for path, subscribers := range tree.watchers {
+		we, ok := e.relativeTo(path)
+		for _, s := range subscribers {
+			switch {
+			case s.wholeTree:
+				s.push(e)
+			case ok:
+				s.push(we)
+			default:
 				continue
 			}
+			notified = append(notified, s)
 		}
 	}
+	return notified
+}
+
+// signal sends an event without data to the watchers of path
+func (tree *treeDB) signal(path, name string) {
+	tree.watchersMtx.RLock()
+	subscribers := append([]*subscriber{}, tree.watchers[path]...)
 	tree.watchersMtx.RUnlock()
+
+	for _, s := range subscribers {
+		s.push(event{Name: name})
+	}
+}
+
+// setQueue sets the queue size and overflow policy
+// used by subscribers created after the call
+func (tree *treeDB) setQueue(size int, policy OverflowPolicy) {
+	tree.watchersMtx.Lock()
+	tree.queueSize, tree.overflow = size, policy
+	tree.watchersMtx.Unlock()
 }
 
 func (tree *treeDB) stopWatching(path string, c chan event) {
 	tree.watchersMtx.Lock()
-	index := -1
-	for i, ch := range tree.watchers[path] {
-		if ch == c {
-			index = i
-			break
+	var remaining []*subscriber
+	for _, s := range tree.watchers[path] {
+		if s.c == c {
+			s.close()
+			continue
 		}
+		remaining = append(remaining, s)
 	}
 
-	if index > -1 {
-		a := tree.watchers[path]
-		tree.watchers[path] = append(a[:index], a[index+1:]...)
-		close(c)
+	if len(remaining) == 0 {
+		delete(tree.watchers, path)
+	} else {
+		tree.watchers[path] = remaining
 	}
 	tree.watchersMtx.Unlock()
 }
 
+// watch adds a watcher at path, which receives the
+// events of the writes at, above and below it
 func (tree *treeDB) watch(path string) chan event {
-	c := make(chan event)
+	tree.mtx.RLock()
+	defer tree.mtx.RUnlock()
+	return tree.subscribe(path, false)
+}
+
+// watchData is watch, but also returns a copy of the data at path
+// with exactly the writes made before the first event delivered
+func (tree *treeDB) watchData(path string) (chan event, *node) {
+	// events are queued while the write lock is held, so the
+	// subscriber receives exactly the writes after the copy
+	tree.mtx.RLock()
+	defer tree.mtx.RUnlock()
+	return tree.subscribe(path, false), tree.lookup(path).clone()
+}
+
+// watchTree is watchData, except that the subscriber receives every
+// event in the tree, relative to the root, along with a copy of the
+// root. Signals for path are still delivered to it.
+func (tree *treeDB) watchTree(path string) (chan event, *node) {
+	tree.mtx.RLock()
+	defer tree.mtx.RUnlock()
+	return tree.subscribe(path, true), tree.rootNode.clone()
+}
 
+// subscribe adds a subscriber at path with the queue set with
+// setQueue. It is called with mtx held so that no write is in
+// progress, since writes only copy the data for the watchers
+// they find when they start.
+func (tree *treeDB) subscribe(path string, wholeTree bool) chan event {
 	tree.watchersMtx.Lock()
-	tree.watchers[path] = append(tree.watchers[path], c)
-	tree.watchersMtx.Unlock()
+	defer tree.watchersMtx.Unlock()
+
+	s := newSubscriber(tree.queueSize, tree.overflow)
+	s.wholeTree = wholeTree
+	tree.watchers[path] = append(tree.watchers[path], s)
+	return s.c
+}
 
-	return c
+// watched reports whether a watcher is at, above or below path and
+// so needs the values before and after a write there. Subscribers to
+// the whole tree do not, as they only use the data of the events.
+func (tree *treeDB) watched(path string) bool {
+	tree.watchersMtx.RLock()
+	defer tree.watchersMtx.RUnlock()
+
+	for p, subscribers := range tree.watchers {
+		_, below := relativePath(path, p)
+		_, above := relativePath(p, path)
+		if !below && !above {
+			continue
+		}
+		for _, s := range subscribers {
+			if !s.wholeTree {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// snapshot returns a copy of the data at path for the events of a
+// write there, or nil if no watcher needs it, so that writes to
+// large parts of the tree are not copied for nothing. It is called
+// with the lock held.
+func (tree *treeDB) snapshot(path string) *node {
+	if !tree.watched(path) {
+		return nil
+	}
+	return tree.lookup(path).clone()
 }
@@ -1,8 +1,12 @@
 package firetest
 
 import (
+	"encoding/json"
+	"errors"
+	"fmt"
 	"regexp"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -34,11 +38,11 @@ func TestTreeAdd(t *testing.T) {
 			assert.True(t, ok)
 			assert.Equal(t, "put", n.Name)
 			assert.Equal(t, test.path, n.Data.Path, "wat?")
-			assert.Equal(t, test.node, n.Data.Data)
+			assert.NoError(t, equalNodes(test.node, n.Data.Data), test.path)
 			close(exited)
 		}()
 
-		tree.add(test.path, test.node)
+		tree.addIf(test.path, test.node, nil)
 
 		rabbitHole := strings.Split(test.path, "/")
 		previous := tree.rootNode
@@ -72,7 +76,7 @@ func TestTreeGet(t *testing.T) {
 		},
 	} {
 		tree := newTree()
-		tree.add(test.path, test.node)
+		tree.addIf(test.path, test.node, nil)
 
 		assert.NoError(t, equalNodes(test.node, tree.get(test.path)), test.path)
 	}
@@ -86,7 +90,7 @@ func TestTreeDel(t *testing.T) {
 	}
 	tree := newTree()
 	for _, p := range existingNodes {
-		tree.add(p, newNode(1))
+		tree.addIf(p, newNode(1), nil)
 	}
 
 	// listen for notifications
@@ -106,7 +110,7 @@ func TestTreeDel(t *testing.T) {
 		close(exited)
 	}()
 
-	tree.del("root/only/one/child")
+	tree.addIf("root/only/one/child", nil, nil)
 	assert.Nil(t, tree.get("root/only/one/child/here"))
 	assert.Nil(t, tree.get("root/only/one/child"))
 	assert.Nil(t, tree.get("root/only/one"))
@@ -116,7 +120,7 @@ func TestTreeDel(t *testing.T) {
 	_, exists := n.children["one"]
 	assert.False(t, exists)
 
-	tree.del("root")
+	tree.addIf("root", nil, nil)
 	n = tree.get("")
 	require.NotNil(t, n)
 	assert.Len(t, n.children, 0)
@@ -127,3 +131,442 @@ func TestTreeDel(t *testing.T) {
 	}
 	tree.stopWatching("", notifications)
 }
+
+func TestTreeDelPrunes(t *testing.T) {
+	tree := newTree()
+	tree.addIf("a/b/c/d", newNode(1), nil)
+	tree.addIf("a/x", newNode(2), nil)
+
+	tree.addIf("a/b/c/d", nil, nil)
+	assert.Equal(t, map[string]interface{}{"a": map[string]interface{}{"x": json.Number("2")}}, tree.get("").objectify())
+
+	tree.addIf("a/x", newNode(nil), nil)
+	assert.Len(t, tree.get("").children, 0)
+}
+
+func TestTreeUpdate(t *testing.T) {
+	tree := newTree()
+	notifications := tree.watch("")
+	defer tree.stopWatching("", notifications)
+
+	tree.addIf("foo", newNode(map[string]interface{}{"bar": 1, "baz": 2}), nil)
+	e := <-notifications
+	assert.Equal(t, "put", e.Name)
+
+	tree.updateIf("foo", newNode(map[string]interface{}{"baz": 3, "qux": 4}), nil)
+	assert.Equal(t, jsonNumbers(map[string]interface{}{"bar": 1, "baz": 3, "qux": 4}), tree.get("foo").objectify())
+
+	select {
+	case e := <-notifications:
+		assert.Equal(t, "patch", e.Name)
+		assert.Equal(t, "foo", e.Data.Path)
+		assert.Equal(t, jsonNumbers(map[string]interface{}{"baz": 3, "qux": 4}), e.Data.Data.objectify())
+	case <-time.After(time.Second):
+		t.Fatal("no patch event received")
+	}
+}
+
+func TestTreeAddIf(t *testing.T) {
+	tree := newTree()
+	tree.clock = func() time.Time { return time.Unix(1437139539, 0) }
+	notifications := tree.watch("")
+	defer tree.stopWatching("", notifications)
+
+	errDenied := errors.New("denied")
+	var checked write
+	_, err := tree.addIf("foo", newNode(map[string]interface{}{".sv": "timestamp"}), func(w write) error {
+		checked = w
+		return errDenied
+	})
+	assert.Equal(t, errDenied, err)
+	assert.Nil(t, tree.get("foo"), "a rejected write should not be made")
+	assert.Equal(t, "foo", checked.path)
+	assert.Equal(t, json.Number("1437139539000"), checked.change(nil).value, "server values should be resolved before the check")
+	select {
+	case <-notifications:
+		t.Fatal("a rejected write should not be notified")
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	_, err = tree.updateIf("", newNode(map[string]interface{}{"a/b": 1, "c": 2}), func(w write) error {
+		checked = w
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, json.Number("1"), tree.get("a/b").value)
+	assert.Len(t, checked.locations, 2)
+}
+
+func TestTreeAddIfMatch(t *testing.T) {
+	tree := newTree()
+	tree.addIf("foo", newNode(1), nil)
+	etag := tree.get("foo").etag()
+
+	_, err := tree.addIf("foo", newNode(2), ifMatch("wrong", nil))
+	assert.Equal(t, errETagMismatch, err)
+	assert.Equal(t, json.Number("1"), tree.get("foo").value)
+
+	stored, err := tree.addIf("foo", newNode(2), ifMatch(etag, nil))
+	assert.NoError(t, err)
+	assert.Equal(t, json.Number("2"), stored.value)
+	assert.Equal(t, json.Number("2"), tree.get("foo").value)
+
+	_, err = tree.addIf("foo", nil, ifMatch(etag, nil))
+	assert.Equal(t, errETagMismatch, err, "etag should have changed")
+
+	_, err = tree.addIf("foo", nil, ifMatch(tree.get("foo").etag(), nil))
+	assert.NoError(t, err)
+	assert.Nil(t, tree.get("foo"))
+
+	_, err = tree.addIf("bar", newNode(3), ifMatch(nullETag, nil))
+	assert.NoError(t, err)
+	assert.Equal(t, json.Number("3"), tree.get("bar").value)
+}
+
+func TestTreeServerValues(t *testing.T) {
+	now := time.Unix(1437139539, 0)
+	tree := newTree()
+	tree.clock = func() time.Time { return now }
+	tree.addIf("counters", newNode(map[string]interface{}{"likes": 10}), nil)
+
+	tree.addIf("post", newNode(map[string]interface{}{
+		"createdAt": map[string]interface{}{".sv": "timestamp"},
+		"likes":     map[string]interface{}{".sv": map[string]interface{}{"increment": 1}},
+	}), nil)
+	assert.Equal(t, json.Number("1437139539000"), tree.get("post/createdAt").value)
+	assert.Equal(t, json.Number("1"), tree.get("post/likes").value)
+
+	tree.updateIf("", newNode(map[string]interface{}{
+		"counters": map[string]interface{}{
+			"likes": map[string]interface{}{".sv": map[string]interface{}{"increment": 5}},
+		},
+	}), nil)
+	assert.Equal(t, json.Number("15"), tree.get("counters/likes").value)
+
+	tree.updateIf("post/likes", newNode(map[string]interface{}{".sv": map[string]interface{}{"increment": -1}}), nil)
+	assert.Equal(t, json.Number("0"), tree.get("post/likes").value)
+}
+
+func TestTreeConcurrentAccess(t *testing.T) {
+	var (
+		tree = newTree()
+		wg   sync.WaitGroup
+	)
+
+	notifications := tree.watch("")
+	done := make(chan struct{})
+	go func() {
+		for e := range notifications {
+			_, err := json.Marshal(e.Data)
+			assert.NoError(t, err)
+		}
+		close(done)
+	}()
+
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				path := fmt.Sprintf("foo/%d/%d", i%3, j%5)
+				switch j % 6 {
+				case 0:
+					tree.addIf(path, newNode(map[string]interface{}{"a": j, "b": i}), nil)
+				case 1:
+					tree.updateIf("foo", newNode(map[string]interface{}{fmt.Sprint(i % 3): j}), nil)
+				case 2:
+					tree.addIf(path, nil, nil)
+				case 3:
+					tree.setPriorityIf(path, j, nil)
+				case 4:
+					tree.get("foo").objectify()
+				case 5:
+					tree.addIf(path, newNode(map[string]interface{}{"time": map[string]interface{}{".sv": "timestamp"}}), nil)
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	tree.stopWatching("", notifications)
+	<-done
+}
+
+func TestTreeNotifyOrder(t *testing.T) {
+	tree := newTree()
+	notifications := tree.watch("counter")
+	defer tree.stopWatching("counter", notifications)
+
+	go func() {
+		for i := 0; i < 500; i++ {
+			tree.addIf("counter", newNode(i), nil)
+		}
+	}()
+
+	for i := 0; i < 500; i++ {
+		e := <-notifications
+		require.Equal(t, jsonNumbers(i), e.Data.Data.value)
+	}
+}
+
+func TestTreeSetQueue(t *testing.T) {
+	tree := newTree()
+	tree.setQueue(2, OverflowDisconnect)
+	notifications := tree.watch("")
+
+	for i := 0; i < 5; i++ {
+		tree.addIf("foo", newNode(i), nil)
+	}
+
+	var names []string
+	for e := range notifications {
+		names = append(names, e.Name)
+	}
+	// one event is held by the delivery goroutine, two fill
+	// the queue and the write after them ends the subscription
+	assert.Equal(t, []string{"put", "put", "put", "put", "cancel"}, names)
+	tree.stopWatching("", notifications)
+}
+
+func TestTreeBlockedWatcher(t *testing.T) {
+	tree := newTree()
+	tree.setQueue(1, OverflowBlock)
+	notifications := tree.watch("")
+	defer tree.stopWatching("", notifications)
+	s := tree.watchers[""][0]
+
+	// the first event is taken off the queue by the
+	// delivery goroutine while it waits on the receiver
+	tree.addIf("foo", newNode(0), nil)
+	waitQueued(s, 0)
+
+	done := make(chan struct{})
+	go func() {
+		for i := 1; i < 3; i++ {
+			tree.addIf("foo", newNode(i), nil)
+		}
+		close(done)
+	}()
+
+	// the last writer waits for room in the
+	// queue, but not with the lock held
+	waitQueued(s, 2)
+	assert.Equal(t, json.Number("2"), tree.get("foo").value)
+
+	for i := 0; i < 3; i++ {
+		<-notifications
+	}
+	<-done
+}
+
+func TestTreeWatched(t *testing.T) {
+	tree := newTree()
+	c := tree.watch("a/b")
+	defer tree.stopWatching("a/b", c)
+	c, _ = tree.watchTree("x")
+	defer tree.stopWatching("x", c)
+
+	assert.True(t, tree.watched(""))
+	assert.True(t, tree.watched("a"))
+	assert.True(t, tree.watched("a/b"))
+	assert.True(t, tree.watched("a/b/c"))
+	assert.False(t, tree.watched("a/c"))
+	assert.False(t, tree.watched("a/bc"))
+	assert.False(t, tree.watched("x"), "whole tree subscribers do not need snapshots")
+
+	tree.addIf("a/c", newNode(1), nil)
+	tree.addIf("x", newNode(1), nil)
+	assert.Nil(t, tree.snapshot("a/c"))
+	assert.Equal(t, json.Number("1"), tree.snapshot("a").children["c"].value)
+}
+
+func TestEventRelativeTo(t *testing.T) {
+	data := newNode(map[string]interface{}{
+		"bar": map[string]interface{}{"baz": 1},
+		"qux": true,
+	})
+
+	for _, test := range []struct {
+		name     string
+		event    event
+		watcher  string
+		ok       bool
+		expected event
+	}{
+		{
+			name:     "same location",
+			event:    event{Name: "put", Data: eventData{Path: "foo", Data: data}},
+			watcher:  "foo",
+			ok:       true,
+			expected: event{Name: "put", Data: eventData{Path: "", Data: data}},
+		},
+		{
+			name:     "root watcher",
+			event:    event{Name: "put", Data: eventData{Path: "foo", Data: data}},
+			watcher:  "",
+			ok:       true,
+			expected: event{Name: "put", Data: eventData{Path: "foo", Data: data}},
+		},
+		{
+			name:     "descendant change",
+			event:    event{Name: "patch", Data: eventData{Path: "foo/bar", Data: data}},
+			watcher:  "foo",
+			ok:       true,
+			expected: event{Name: "patch", Data: eventData{Path: "bar", Data: data}},
+		},
+		{
+			name:    "sibling with common prefix",
+			event:   event{Name: "put", Data: eventData{Path: "foobar", Data: data}},
+			watcher: "foo",
+		},
+		{
+			name:     "ancestor put",
+			event:    event{Name: "put", Data: eventData{Path: "foo", Data: data}},
+			watcher:  "foo/bar",
+			ok:       true,
+			expected: event{Name: "put", Data: eventData{Data: data.children["bar"]}},
+		},
+		{
+			name:     "ancestor put without the watched child",
+			event:    event{Name: "put", Data: eventData{Path: "foo", Data: data}},
+			watcher:  "foo/nope",
+			ok:       true,
+			expected: event{Name: "put", Data: eventData{}},
+		},
+		{
+			name:     "ancestor delete",
+			event:    event{Name: "put", Data: eventData{Path: "foo"}},
+			watcher:  "foo/bar/baz",
+			ok:       true,
+			expected: event{Name: "put", Data: eventData{}},
+		},
+		{
+			name:     "ancestor patch",
+			event:    event{Name: "patch", Data: eventData{Path: "foo", Data: data}},
+			watcher:  "foo/bar/baz",
+			ok:       true,
+			expected: event{Name: "put", Data: eventData{Data: data.child("bar/baz")}},
+		},
+		{
+			name:    "ancestor patch of other children",
+			event:   event{Name: "patch", Data: eventData{Path: "foo", Data: data}},
+			watcher: "foo/nope",
+		},
+	} {
+		e, ok := test.event.relativeTo(test.watcher)
+		assert.Equal(t, test.ok, ok, test.name)
+		if test.ok {
+			assert.Equal(t, test.expected, e, test.name)
+		}
+	}
+}
+
+func TestTreeUpdatePaths(t *testing.T) {
+	tree := newTree()
+	tree.addIf("users", newNode(map[string]interface{}{
+		"alice": map[string]interface{}{"name": "Alice", "age": 30},
+		"bob":   map[string]interface{}{"name": "Bob"},
+	}), nil)
+
+	// receive events from all watchers at
+	// once since notify delivers them in turn
+	received := map[string]chan event{}
+	for _, path := range []string{"", "users/alice", "users/alice/name", "users/bob", "users/carol"} {
+		c, r := tree.watch(path), make(chan event, 2)
+		received[path] = r
+		go func() {
+			for e := range c {
+				r <- e
+			}
+		}()
+		defer tree.stopWatching(path, c)
+	}
+
+	n, err := newUpdate("", map[string]interface{}{
+		"users/alice/name": "Alicia",
+		"users/bob":        nil,
+		"count":            2,
+	})
+	require.NoError(t, err)
+	tree.updateIf("", n, nil)
+
+	assert.Equal(t, map[string]interface{}{
+		"users": map[string]interface{}{
+			"alice": map[string]interface{}{"name": "Alicia", "age": json.Number("30")},
+		},
+		"count": json.Number("2"),
+	}, tree.get("").objectify())
+
+	for _, test := range []struct {
+		watcher string
+		name    string
+		data    interface{}
+	}{
+		{"", "patch", map[string]interface{}{"users/alice/name": "Alicia", "users/bob": nil, "count": 2}},
+		{"users/alice", "patch", map[string]interface{}{"name": "Alicia"}},
+		{"users/alice/name", "put", "Alicia"},
+		{"users/bob", "put", nil},
+	} {
+		select {
+		case e := <-received[test.watcher]:
+			assert.Equal(t, test.name, e.Name, test.watcher)
+			assert.Equal(t, "", e.Data.Path, test.watcher)
+			assert.Equal(t, jsonNumbers(test.data), e.Data.Data.objectify(), test.watcher)
+		case <-time.After(time.Second):
+			t.Fatalf("no event received for watcher at %q", test.watcher)
+		}
+	}
+
+	for path, r := range received {
+		select {
+		case e := <-r:
+			t.Fatalf("unexpected event %v for watcher at %q", e, path)
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+}
+
+func TestTreeNotifyRouting(t *testing.T) {
+	tree := newTree()
+
+	// receive events from all watchers at
+	// once since notify delivers them in turn
+	received := map[string]chan event{}
+	for _, path := range []string{"", "foo", "foobar", "foo/bar"} {
+		c, r := tree.watch(path), make(chan event, 1)
+		received[path] = r
+		go func() {
+			for e := range c {
+				r <- e
+			}
+		}()
+		defer tree.stopWatching(path, c)
+	}
+
+	tree.addIf("foo", newNode(map[string]interface{}{"bar": "baz"}), nil)
+
+	for _, test := range []struct {
+		watcher string
+		path    string
+		data    interface{}
+	}{
+		{"", "foo", map[string]interface{}{"bar": "baz"}},
+		{"foo", "", map[string]interface{}{"bar": "baz"}},
+		{"foo/bar", "", "baz"},
+	} {
+		select {
+		case e := <-received[test.watcher]:
+			assert.Equal(t, "put", e.Name, test.watcher)
+			assert.Equal(t, test.path, e.Data.Path, test.watcher)
+			assert.Equal(t, test.data, e.Data.Data.objectify(), test.watcher)
+		case <-time.After(time.Second):
+			t.Fatalf("no event received for watcher at %q", test.watcher)
+		}
+	}
+
+	select {
+	case e := <-received["foobar"]:
+		t.Fatalf("unexpected event %v", e)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
@@ -1,7 +1,9 @@
 package firetest
 
 import (
+	"bytes"
 	"encoding/json"
+	"errors"
 	"io"
 	"io/ioutil"
 	"net/http"
@@ -22,19 +24,80 @@ func sanitizePath(p string) string {
 	return strings.TrimSuffix(s, "/")
 }
 
-func unmarshal(w http.ResponseWriter, r io.Reader) ([]byte, interface{}, bool) {
-	body, err := ioutil.ReadAll(r)
+// joinPath appends the child key to the parent path
+//
+//	"", foo -> foo
+//	foo, bar -> foo/bar
+func joinPath(parent, child string) string {
+	if parent == "" {
+		return child
+	}
+	return parent + "/" + child
+}
+
+// relativePath returns path relative to base if path is
+// base itself or one of its descendants
+//
+//	foo, foo/bar -> bar
+//	foo, foo -> ""
+//	foo, foobar -> false
+func relativePath(base, path string) (string, bool) {
+	switch {
+	case base == "":
+		return path, true
+	case path == base:
+		return "", true
+	case strings.HasPrefix(path, base+"/"):
+		return path[len(base)+1:], true
+	}
+	return "", false
+}
+
+// priorityPath returns the path of the node whose
+// priority is referenced by p, if p ends in .priority
+//
+//	foo/.priority -> foo
+func priorityPath(p string) (string, bool) {
+	if p != priorityKey && !strings.HasSuffix(p, "/"+priorityKey) {
+		return p, false
+	}
+	return strings.TrimSuffix(strings.TrimSuffix(p, priorityKey), "/"), true
+}
+
+// unmarshal reads the JSON body of a write request, which
+// must not be larger than maxSize bytes
+func unmarshal(w http.ResponseWriter, r io.Reader, maxSize int64) ([]byte, interface{}, bool) {
+	body, err := ioutil.ReadAll(io.LimitReader(r, maxSize+1))
 	if err != nil || len(body) == 0 {
 		w.WriteHeader(http.StatusBadRequest)
 		w.Write(missingBody)
 		return nil, nil, false
 	}
+	if int64(len(body)) > maxSize {
+		writeError(w, http.StatusBadRequest, errWriteTooLarge)
+		return nil, nil, false
+	}
 
-	var v interface{}
-	if err := json.Unmarshal(body, &v); err != nil {
+	v, err := decodeJSON(body)
+	if err != nil {
 		w.WriteHeader(http.StatusBadRequest)
 		w.Write(invalidJSON)
 		return nil, nil, false
 	}
 	return body, v, true
 }
+
+// decodeJSON decodes the single JSON value in b, keeping
+// numbers as json.Number so that they are not rounded
+func decodeJSON(b []byte) (interface{}, error) {
+	var v, extra interface{}
+	d := json.NewDecoder(bytes.NewReader(b))
+	d.UseNumber()
+	if err := d.Decode(&v); err != nil {
+		return nil, err
+	}
+	if d.Decode(&extra) != io.EOF {
+		return nil, errors.New("firetest: unexpected data after JSON value")
+	}
+	return v, nil
+}
@@ -2,6 +2,7 @@ package firetest
 
 import (
 	"bytes"
+	"encoding/json"
 	"net/http"
 	"net/http/httptest"
 	"strings"
@@ -26,12 +27,31 @@ func TestSanitizePath(t *testing.T) {
 	}
 }
 
+func TestPriorityPath(t *testing.T) {
+	for _, test := range []struct {
+		path     string
+		expected string
+		priority bool
+	}{
+		{"", "", false},
+		{"foo", "foo", false},
+		{"foo.priority", "foo.priority", false},
+		{".priority", "", true},
+		{"foo/.priority", "foo", true},
+		{"foo/bar/.priority", "foo/bar", true},
+	} {
+		p, ok := priorityPath(test.path)
+		assert.Equal(t, test.expected, p, test.path)
+		assert.Equal(t, test.priority, ok, test.path)
+	}
+}
+
 func TestUnmarshal(t *testing.T) {
 	v := "foo"
 	jsonV := `"foo"`
 	w := httptest.NewRecorder()
 	r := strings.NewReader(jsonV)
-	b, val, ok := unmarshal(w, r)
+	b, val, ok := unmarshal(w, r, DefaultLimits.MaxWriteSize)
 	assert.Equal(t, []byte(jsonV), b)
 	assert.Equal(t, v, val)
 	assert.True(t, ok)
@@ -40,7 +60,7 @@ func TestUnmarshal(t *testing.T) {
 func TestUnmarshal_MissingBody(t *testing.T) {
 	w := httptest.NewRecorder()
 	r := bytes.NewReader(nil)
-	b, val, ok := unmarshal(w, r)
+	b, val, ok := unmarshal(w, r, DefaultLimits.MaxWriteSize)
 	assert.Nil(t, b)
 	assert.Nil(t, val)
 	assert.False(t, ok)
@@ -52,7 +72,7 @@ func TestUnmarshal_MissingBody(t *testing.T) {
 func TestUnmarshal_InvalidBody(t *testing.T) {
 	w := httptest.NewRecorder()
 	r := strings.NewReader("{asda}")
-	b, val, ok := unmarshal(w, r)
+	b, val, ok := unmarshal(w, r, DefaultLimits.MaxWriteSize)
 	assert.Nil(t, b)
 	assert.Nil(t, val)
 	assert.False(t, ok)
@@ -60,3 +80,44 @@ func TestUnmarshal_InvalidBody(t *testing.T) {
 	assert.Equal(t, http.StatusBadRequest, w.Code)
 	assert.Equal(t, []byte(invalidJSON), w.Body.Bytes())
 }
+
+func TestUnmarshal_Numbers(t *testing.T) {
+	w := httptest.NewRecorder()
+	r := strings.NewReader(`{"big":9007199254740993,"small":1.5}`)
+	_, val, ok := unmarshal(w, r, DefaultLimits.MaxWriteSize)
+	assert.True(t, ok)
+	assert.Equal(t, map[string]interface{}{
+		"big":   json.Number("9007199254740993"),
+		"small": json.Number("1.5"),
+	}, val)
+}
+
+func TestUnmarshal_TrailingData(t *testing.T) {
+	w := httptest.NewRecorder()
+	r := strings.NewReader(`{"foo":1} {"bar":2}`)
+	_, val, ok := unmarshal(w, r, DefaultLimits.MaxWriteSize)
+	assert.Nil(t, val)
+	assert.False(t, ok)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func TestRelativePath(t *testing.T) {
+	for _, test := range []struct {
+		base, path string
+		expected   string
+		ok         bool
+	}{
+		{"", "", "", true},
+		{"", "foo/bar", "foo/bar", true},
+		{"foo", "foo", "", true},
+		{"foo", "foo/bar", "bar", true},
+		{"foo", "foo/bar/baz", "bar/baz", true},
+		{"foo", "foobar", "", false},
+		{"foo", "", "", false},
+		{"foo/bar", "foo", "", false},
+	} {
+		rel, ok := relativePath(test.base, test.path)
+		assert.Equal(t, test.expected, rel, "%q %q", test.base, test.path)
+		assert.Equal(t, test.ok, ok, "%q %q", test.base, test.path)
+	}
+}
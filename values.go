@@ -0,0 +1,173 @@
+package firetest
+
+import (
+	"encoding/json"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const serverValueKey = ".sv"
+
+// serverValue is a placeholder written by clients that is
+// replaced with its actual value when stored in the tree.
+//
+// Reference https://www.firebase.com/docs/rest/api/#section-server-values
+type serverValue struct {
+	timestamp bool
+	increment json.Number
+}
+
+// newServerValue parses the contents of a .sv key. It returns
+// false if v does not describe a known server value.
+func newServerValue(v interface{}) (*serverValue, bool) {
+	switch v := v.(type) {
+	case string:
+		if v == "timestamp" {
+			return &serverValue{timestamp: true}, true
+		}
+	case map[string]interface{}:
+		if delta, ok := newNumber(v["increment"]); ok {
+			return &serverValue{increment: delta}, true
+		}
+	}
+	return nil, false
+}
+
+// resolve returns the value the placeholder stands for given
+// the current time and the node currently stored at its location.
+func (sv *serverValue) resolve(now time.Time, current *node) json.Number {
+	if sv.timestamp {
+		return json.Number(strconv.FormatInt(millis(now), 10))
+	}
+
+	if current.isNil() || len(current.children) > 0 || !isNumber(current.value) {
+		return sv.increment
+	}
+	return addNumbers(current.value, sv.increment)
+}
+
+// millis returns t in milliseconds since the Unix epoch
+func millis(t time.Time) int64 {
+	return t.UnixNano() / int64(time.Millisecond)
+}
+
+// newNumber returns the json.Number all numbers are stored as, which
+// makes the data the same whether it was written over the REST API or
+// with a Go number. Integers are kept exactly as they are written, even
+// those that do not fit in an int64 or a float64, and so are other
+// numbers that do not fit in a float64. The rest are written the
+// shortest way that reads back as the same float64.
+func newNumber(v interface{}) (json.Number, bool) {
+	switch v := v.(type) {
+	case int:
+		return json.Number(strconv.FormatInt(int64(v), 10)), true
+	case int8:
+		return json.Number(strconv.FormatInt(int64(v), 10)), true
+	case int16:
+		return json.Number(strconv.FormatInt(int64(v), 10)), true
+	case int32:
+		return json.Number(strconv.FormatInt(int64(v), 10)), true
+	case int64:
+		return json.Number(strconv.FormatInt(v, 10)), true
+	case uint:
+		return json.Number(strconv.FormatUint(uint64(v), 10)), true
+	case uint8:
+		return json.Number(strconv.FormatUint(uint64(v), 10)), true
+	case uint16:
+		return json.Number(strconv.FormatUint(uint64(v), 10)), true
+	case uint32:
+		return json.Number(strconv.FormatUint(uint64(v), 10)), true
+	case uint64:
+		return json.Number(strconv.FormatUint(v, 10)), true
+	case float32:
+		return formatFloat(float64(v))
+	case float64:
+		return formatFloat(v)
+	case json.Number:
+		if isIntegerLiteral(string(v)) {
+			if v == "-0" {
+				return "0", true
+			}
+			return v, true
+		}
+		f, err := v.Float64()
+		if err, ok := err.(*strconv.NumError); ok && err.Err == strconv.ErrRange {
+			return v, true
+		}
+		if err != nil {
+			return "", false
+		}
+		return formatFloat(f)
+	}
+	return "", false
+}
+
+// formatFloat formats f without a fraction or an exponent if
+// it is a small enough integer, just like JavaScript does
+func formatFloat(f float64) (json.Number, bool) {
+	switch {
+	case math.IsNaN(f) || math.IsInf(f, 0):
+		return "", false
+	case f == 0:
+		return "0", true
+	case f == math.Trunc(f) && math.Abs(f) < 1e21:
+		return json.Number(strconv.FormatFloat(f, 'f', -1, 64)), true
+	}
+	return json.Number(strconv.FormatFloat(f, 'g', -1, 64)), true
+}
+
+// isIntegerLiteral reports whether s is a JSON number without
+// a fraction or an exponent
+func isIntegerLiteral(s string) bool {
+	s = strings.TrimPrefix(s, "-")
+	if s == "" || s[0] == '0' && s != "0" {
+		return false
+	}
+	for _, c := range s {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+func isNumber(v interface{}) bool {
+	_, ok := newNumber(v)
+	return ok
+}
+
+// toInt returns v as an int64 if it is an integer that fits in one
+func toInt(v interface{}) (int64, bool) {
+	n, ok := newNumber(v)
+	if !ok || !isIntegerLiteral(string(n)) {
+		return 0, false
+	}
+
+	i, err := n.Int64()
+	return i, err == nil
+}
+
+func toFloat(v interface{}) float64 {
+	n, _ := newNumber(v)
+	f, _ := n.Float64()
+	return f
+}
+
+// addNumbers sums two numbers, keeping the result exact
+// when both numbers are integers that fit in an int64. A sum
+// that does not fit in a float64 leaves a as it is.
+func addNumbers(a, b interface{}) json.Number {
+	ai, aIsInt := toInt(a)
+	bi, bIsInt := toInt(b)
+	if sum := ai + bi; aIsInt && bIsInt && (sum > ai) == (bi > 0) {
+		return json.Number(strconv.FormatInt(sum, 10))
+	}
+
+	if n, ok := formatFloat(toFloat(a) + toFloat(b)); ok {
+		return n
+	}
+	n, _ := newNumber(a)
+	return n
+}
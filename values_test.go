@@ -0,0 +1,131 @@
+package firetest
+
+import (
+	"encoding/json"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewServerValue(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		v        interface{}
+		expected *serverValue
+	}{
+		{
+			name:     "timestamp",
+			v:        "timestamp",
+			expected: &serverValue{timestamp: true},
+		},
+		{
+			name:     "increment",
+			v:        map[string]interface{}{"increment": 2.0},
+			expected: &serverValue{increment: "2"},
+		},
+		{
+			name: "unknown string",
+			v:    "now",
+		},
+		{
+			name: "non numeric increment",
+			v:    map[string]interface{}{"increment": "1"},
+		},
+		{
+			name: "missing",
+		},
+	} {
+		sv, ok := newServerValue(test.v)
+		assert.Equal(t, test.expected != nil, ok, test.name)
+		assert.Equal(t, test.expected, sv, test.name)
+	}
+}
+
+func TestNewNumber(t *testing.T) {
+	for _, test := range []struct {
+		v        interface{}
+		expected json.Number
+	}{
+		{1, "1"},
+		{int64(-9007199254740993), "-9007199254740993"},
+		{uint64(18446744073709551615), "18446744073709551615"},
+		{3.0, "3"},
+		{-0.0, "0"},
+		{2.5, "2.5"},
+		{float32(0.5), "0.5"},
+		{1e20, "100000000000000000000"},
+		{1e21, "1e+21"},
+		{json.Number("9007199254740993"), "9007199254740993"},
+		{json.Number("-0"), "0"},
+		{json.Number("3.0"), "3"},
+		{json.Number("1.5e2"), "150"},
+		{json.Number("1e400"), "1e400"},
+		{json.Number("-1e400"), "-1e400"},
+	} {
+		n, ok := newNumber(test.v)
+		assert.True(t, ok, "%v", test.v)
+		assert.Equal(t, test.expected, n, "%v", test.v)
+	}
+
+	for _, v := range []interface{}{"1", true, nil, math.NaN(), math.Inf(1), json.Number("abc")} {
+		_, ok := newNumber(v)
+		assert.False(t, ok, "%v", v)
+	}
+}
+
+func TestAddNumbers(t *testing.T) {
+	assert.Equal(t, json.Number("9007199254740994"), addNumbers(json.Number("9007199254740993"), 1))
+	assert.Equal(t, json.Number("3.5"), addNumbers(2, 1.5))
+	assert.Equal(t, json.Number("18446744073709552000"), addNumbers(int64(math.MaxInt64), int64(math.MaxInt64)), "overflowing sums fall back to floats")
+	assert.Equal(t, json.Number("1e+308"), addNumbers(json.Number("1e308"), 1e308), "sums too large for a float64 are not made")
+}
+
+func TestServerValueResolve(t *testing.T) {
+	now := time.Unix(1437139539, 0)
+	for _, test := range []struct {
+		name     string
+		sv       *serverValue
+		current  *node
+		expected interface{}
+	}{
+		{
+			name:     "timestamp",
+			sv:       &serverValue{timestamp: true},
+			current:  newNode("foo"),
+			expected: json.Number("1437139539000"),
+		},
+		{
+			name:     "increment missing value",
+			sv:       &serverValue{increment: "2"},
+			expected: json.Number("2"),
+		},
+		{
+			name:     "increment integer",
+			sv:       &serverValue{increment: "2"},
+			current:  newNode(40),
+			expected: json.Number("42"),
+		},
+		{
+			name:     "increment decimal",
+			sv:       &serverValue{increment: "1.5"},
+			current:  newNode(40),
+			expected: json.Number("41.5"),
+		},
+		{
+			name:     "increment string",
+			sv:       &serverValue{increment: "2"},
+			current:  newNode("40"),
+			expected: json.Number("2"),
+		},
+		{
+			name:     "increment object",
+			sv:       &serverValue{increment: "2"},
+			current:  newNode(map[string]interface{}{"foo": 1}),
+			expected: json.Number("2"),
+		},
+	} {
+		assert.Equal(t, test.expected, test.sv.resolve(now, test.current), test.name)
+	}
+}
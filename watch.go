@@ -0,0 +1,82 @@
+package firetest
+
+import "sync"
+
+// Op is the kind of write that produced an Event
+type Op string
+
+const (
+	// OpPut replaces the data at a location, which
+	// includes setting priorities and deleting data
+	OpPut Op = "put"
+	// OpPatch updates some of the children of a location
+	OpPatch Op = "patch"
+)
+
+// Event describes a change to the data of a Firetest server
+type Event struct {
+	// Op is the kind of write that made the change
+	Op Op
+	// Path is the absolute location of the change, e.g. /users/alice.
+	// Writes to an ancestor of the watched location are reported
+	// as a put at the watched location.
+	Path string
+	// Old and New are the values at Path before and after the change
+	Old, New interface{}
+}
+
+// Watch returns a channel on which the changes made at and below the
+// given location are delivered in order, along with a function that
+// stops watching and closes the channel.
+func (ft *Firetest) Watch(path string) (<-chan Event, func(), error) {
+	path, err := ft.validPath(path)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var (
+		c      = ft.db.watch(path)
+		events = make(chan Event)
+		stop   = make(chan struct{})
+		once   sync.Once
+	)
+
+	go func() {
+		defer close(events)
+		for e := range c {
+			if e.Name != eventPut && e.Name != eventPatch {
+				// cancel and auth_revoked only apply to streams
+				continue
+			}
+
+			select {
+			case events <- newPublicEvent(path, e):
+			case <-stop:
+				return
+			}
+		}
+	}()
+
+	cancel := func() {
+		once.Do(func() {
+			close(stop)
+			ft.db.stopWatching(path, c)
+		})
+	}
+	return events, cancel, nil
+}
+
+// newPublicEvent converts e, as received
+// by a watcher at path, to an Event
+func newPublicEvent(path string, e event) Event {
+	if e.Data.Path != "" {
+		path = joinPath(path, e.Data.Path)
+	}
+
+	return Event{
+		Op:   Op(e.Name),
+		Path: "/" + path,
+		Old:  e.before.objectify(),
+		New:  e.after.objectify(),
+	}
+}
@@ -0,0 +1,108 @@
+package firetest
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWatch(t *testing.T) {
+	ft := New()
+	ft.Set("users/alice", map[string]interface{}{"name": "Alice"})
+
+	events, cancel, err := ft.Watch("/users")
+	require.NoError(t, err)
+	defer cancel()
+
+	ft.Set("users/bob", map[string]interface{}{"name": "Bob"})
+	ft.Update("users/alice", map[string]interface{}{"age": 30})
+	ft.Set("users/alice/.priority", 1)
+	ft.Delete("users/bob")
+	ft.Set("other", true)
+	ft.Set("", map[string]interface{}{"users": "gone"})
+
+	for _, expected := range []Event{
+		{
+			Op:   OpPut,
+			Path: "/users/bob",
+			New:  map[string]interface{}{"name": "Bob"},
+		},
+		{
+			Op:   OpPatch,
+			Path: "/users/alice",
+			Old:  map[string]interface{}{"name": "Alice"},
+			New:  map[string]interface{}{"name": "Alice", "age": 30},
+		},
+		{
+			Op:   OpPut,
+			Path: "/users/alice",
+			Old:  map[string]interface{}{"name": "Alice", "age": 30},
+			New:  map[string]interface{}{"name": "Alice", "age": 30},
+		},
+		{
+			Op:   OpPut,
+			Path: "/users/bob",
+			Old:  map[string]interface{}{"name": "Bob"},
+		},
+		{
+			Op:   OpPut,
+			Path: "/users",
+			Old: map[string]interface{}{
+				"alice": map[string]interface{}{"name": "Alice", "age": 30},
+			},
+			New: "gone",
+		},
+	} {
+		select {
+		case e := <-events:
+			assert.Equal(t, Event{
+				Op:   expected.Op,
+				Path: expected.Path,
+				Old:  jsonNumbers(expected.Old),
+				New:  jsonNumbers(expected.New),
+			}, e)
+		case <-time.After(time.Second):
+			t.Fatalf("no event received, expected %v", expected)
+		}
+	}
+}
+
+func TestWatchCancel(t *testing.T) {
+	ft := New()
+	events, cancel, err := ft.Watch("foo")
+	require.NoError(t, err)
+	cancel()
+	cancel()
+
+	ft.Set("foo", 1)
+	select {
+	case _, ok := <-events:
+		assert.False(t, ok, "channel should be closed")
+	case <-time.After(time.Second):
+		t.Fatal("channel was not closed")
+	}
+}
+
+func TestWatchCancelWithoutReceiving(t *testing.T) {
+	ft := New()
+	events, cancel, err := ft.Watch("")
+	require.NoError(t, err)
+
+	for i := 0; i < 5; i++ {
+		ft.Set("foo", i)
+	}
+	e := <-events
+	require.Equal(t, json.Number("0"), e.New)
+
+	cancel()
+	for range events {
+	}
+}
+
+func TestWatchInvalidPath(t *testing.T) {
+	_, _, err := New().Watch("a.b")
+	assert.Equal(t, &PathError{Path: "a.b", Key: "a.b", Err: ErrInvalidKey}, err)
+}